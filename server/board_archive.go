@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// boardArchiveVersion is the version of the boards archive format written by
+// archiveBoard, which boards can import with "Import archive".
+const boardArchiveVersion = 2
+
+type archiveColumnKind int
+
+const (
+	archiveText archiveColumnKind = iota
+	archiveNumber
+	archiveBool
+	archiveJSON
+)
+
+// archiveColumn is a column exported to a board archive. Columns missing from
+// the installed boards version are left out.
+type archiveColumn struct {
+	name string
+	kind archiveColumnKind
+}
+
+var boardArchiveColumns = []archiveColumn{
+	{"id", archiveText},
+	{"team_id", archiveText},
+	{"channel_id", archiveText},
+	{"created_by", archiveText},
+	{"modified_by", archiveText},
+	{"type", archiveText},
+	{"minimum_role", archiveText},
+	{"title", archiveText},
+	{"description", archiveText},
+	{"icon", archiveText},
+	{"show_description", archiveBool},
+	{"is_template", archiveBool},
+	{"template_version", archiveNumber},
+	{"properties", archiveJSON},
+	{"card_properties", archiveJSON},
+	{"create_at", archiveNumber},
+	{"update_at", archiveNumber},
+	{"delete_at", archiveNumber},
+}
+
+var blockArchiveColumns = []archiveColumn{
+	{"id", archiveText},
+	{"parent_id", archiveText},
+	{"board_id", archiveText},
+	{"created_by", archiveText},
+	{"modified_by", archiveText},
+	{"schema", archiveNumber},
+	{"type", archiveText},
+	{"title", archiveText},
+	{"fields", archiveJSON},
+	{"create_at", archiveNumber},
+	{"update_at", archiveNumber},
+	{"delete_at", archiveNumber},
+}
+
+// boardArchive records where a board was archived before it was deleted.
+type boardArchive struct {
+	BoardID string
+	Title   string
+	FileID  string
+	Path    string
+}
+
+type archiveHeader struct {
+	Version int   `json:"version"`
+	Date    int64 `json:"date"`
+}
+
+type archiveLine struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// archiveBoard writes the board, its blocks and its attachments to a
+// .boardarchive file, either in the configured archive directory or as a
+// reply to the job's status post, and records it on the job.
+func archiveBoard(env *cleanupEnv, boardID string) error {
+	boards, err := queryArchiveRows(env, "focalboard_boards", boardArchiveColumns, sq.Eq{"id": boardID})
+	if err != nil {
+		return fmt.Errorf("error when trying to read board: %s", err.Error())
+	}
+	if len(boards) == 0 {
+		return fmt.Errorf("board %s not found", boardID)
+	}
+	board := boards[0]
+
+	blocks, err := queryArchiveRows(env, "focalboard_blocks", blockArchiveColumns, sq.Eq{"board_id": boardID})
+	if err != nil {
+		return fmt.Errorf("error when trying to read board blocks: %s", err.Error())
+	}
+
+	// Attachments can be large, so the archive is written to a temporary
+	// file rather than kept in memory.
+	archive, err := os.CreateTemp("", "bulk-user-delete-board-*.boardarchive")
+	if err != nil {
+		return fmt.Errorf("error when trying to create board archive file: %s", err.Error())
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	if err = writeBoardArchive(env, archive, boardID, board, blocks); err != nil {
+		return err
+	}
+	if _, err = archive.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error when trying to read board archive file: %s", err.Error())
+	}
+
+	title, _ := board["title"].(string)
+	archiveName := fmt.Sprintf("%d-%s.boardarchive", model.GetMillis(), boardID)
+	result := boardArchive{BoardID: boardID, Title: title}
+
+	if directory := env.config.BoardArchiveDirectory; directory != "" {
+		if err = os.MkdirAll(directory, 0700); err != nil {
+			return fmt.Errorf("error when trying to create board archive directory: %s", err.Error())
+		}
+		result.Path = filepath.Join(directory, archiveName)
+		if err = copyToNewFile(result.Path, archive); err != nil {
+			return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+		}
+	} else {
+		if env.statusPost == nil {
+			return fmt.Errorf("no board archive directory is configured")
+		}
+		fileInfo, uploadErr := env.pluginClient.File.Upload(archive, archiveName, env.statusPost.ChannelId)
+		if uploadErr != nil {
+			return fmt.Errorf("error when trying to upload board archive: %s", uploadErr.Error())
+		}
+		result.FileID = fileInfo.Id
+
+		archivePost := &model.Post{
+			UserId:    env.statusPost.UserId,
+			ChannelId: env.statusPost.ChannelId,
+			RootId:    env.statusPost.Id,
+			Message:   fmt.Sprintf("Archive of board **%s** before it was deleted:", title),
+			FileIds:   model.StringArray{fileInfo.Id},
+		}
+		if err = env.pluginClient.Post.CreatePost(archivePost); err != nil {
+			return fmt.Errorf("error when trying to post board archive: %s", err.Error())
+		}
+	}
+
+	if env.deletionJob != nil {
+		env.deletionJob.BoardArchives = append(env.deletionJob.BoardArchives, result)
+	}
+	return nil
+}
+
+// copyToNewFile writes the content to a new file readable only by the server.
+func copyToNewFile(path string, content io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = io.Copy(file, content); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func writeBoardArchive(env *cleanupEnv, w io.Writer, boardID string, board map[string]interface{}, blocks []map[string]interface{}) error {
+	archive := zip.NewWriter(w)
+
+	header, err := archive.Create("version.json")
+	if err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+	if err = json.NewEncoder(header).Encode(archiveHeader{Version: boardArchiveVersion, Date: model.GetMillis()}); err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+
+	content, err := archive.Create(boardID + "/board.jsonl")
+	if err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+	encoder := json.NewEncoder(content)
+	if err = encoder.Encode(archiveLine{Type: "board", Data: board}); err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+	for _, block := range blocks {
+		if err = encoder.Encode(archiveLine{Type: "block", Data: block}); err != nil {
+			return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+		}
+	}
+
+	for _, block := range blocks {
+		fileID := blockFileID(block)
+		if fileID == "" {
+			continue
+		}
+		if err = writeBoardArchiveFile(env, archive, boardID, fileID); err != nil {
+			return err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+	return nil
+}
+
+// writeBoardArchiveFile copies an attachment into the archive, next to the
+// board's blocks. Attachments whose file can't be found are left out.
+func writeBoardArchiveFile(env *cleanupEnv, archive *zip.Writer, boardID, fileID string) error {
+	query := sq.Select("Path").
+		From("FileInfo").
+		Where(sq.Eq{"CreatorId": "boards"}).
+		Where(sq.Like{"Path": "%" + fileID}).
+		PlaceholderFormat(env.db.placeholder())
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the board file query: %s", err.Error())
+	}
+
+	paths, err := queryIDs(env.db, queryString, args...)
+	if err != nil {
+		return fmt.Errorf("error when trying to find board file: %s", err.Error())
+	}
+	if len(paths) == 0 {
+		env.pluginClient.Log.Warn("Board file not found, leaving it out of the archive", "board_id", boardID, "file_id", fileID)
+		return nil
+	}
+
+	file, err := env.pluginClient.File.GetByPath(paths[0])
+	if err != nil {
+		env.pluginClient.Log.Warn("Unable to read board file, leaving it out of the archive", "board_id", boardID, "file_id", fileID, "error", err)
+		return nil
+	}
+
+	entry, err := archive.Create(boardID + "/" + fileID)
+	if err != nil {
+		return fmt.Errorf("error when trying to write board archive: %s", err.Error())
+	}
+	if _, err = io.Copy(entry, file); err != nil {
+		return fmt.Errorf("error when trying to write board file to archive: %s", err.Error())
+	}
+	return nil
+}
+
+// blockFileID returns the file ID of an image or attachment block.
+func blockFileID(block map[string]interface{}) string {
+	fields, ok := block["fields"].(json.RawMessage)
+	if !ok {
+		return ""
+	}
+	var file struct {
+		FileID string `json:"fileId"`
+	}
+	if err := json.Unmarshal(fields, &file); err != nil {
+		return ""
+	}
+	return file.FileID
+}
+
+// queryArchiveRows reads the given columns of a boards table, keyed by the
+// names the boards archive format uses.
+func queryArchiveRows(env *cleanupEnv, table string, columns []archiveColumn, where sq.Eq) ([]map[string]interface{}, error) {
+	tableName, ok := env.tables[table]
+	if !ok {
+		return nil, fmt.Errorf("table %s does not exist", table)
+	}
+	tableColumns, err := getTableColumns(env.db, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []archiveColumn
+	var selectNames []string
+	for _, column := range columns {
+		info, ok := tableColumns[column.name]
+		if !ok {
+			continue
+		}
+		selected = append(selected, column)
+		selectNames = append(selectNames, env.db.quoteIdentifier(info.Name))
+	}
+
+	queryString, args, err := sq.Select(selectNames...).
+		From(tableName).
+		Where(where).
+		PlaceholderFormat(env.db.placeholder()).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the %s query: %s", table, err.Error())
+	}
+
+	rows, err := env.db.Query(queryString, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(selected))
+		for i, column := range selected {
+			switch column.kind {
+			case archiveNumber:
+				values[i] = &sql.NullInt64{}
+			case archiveBool:
+				values[i] = &sql.NullBool{}
+			default:
+				values[i] = &sql.NullString{}
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+
+		row := map[string]interface{}{}
+		for i, column := range selected {
+			var value interface{}
+			switch v := values[i].(type) {
+			case *sql.NullInt64:
+				if v.Valid {
+					value = v.Int64
+				}
+			case *sql.NullBool:
+				if v.Valid {
+					value = v.Bool
+				}
+			case *sql.NullString:
+				if !v.Valid {
+					break
+				}
+				value = v.String
+				if column.kind == archiveJSON {
+					value = nil
+					if json.Valid([]byte(v.String)) {
+						value = json.RawMessage(v.String)
+					}
+				}
+			}
+			row[archiveKey(column.name)] = value
+		}
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// archiveKey converts a boards column name to the key the archive format
+// uses for it, such as card_properties to cardProperties.
+func archiveKey(column string) string {
+	parts := strings.Split(column, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_archiveKey(t *testing.T) {
+	tests := []struct {
+		column   string
+		expected string
+	}{
+		{column: "id", expected: "id"},
+		{column: "board_id", expected: "boardId"},
+		{column: "card_properties", expected: "cardProperties"},
+		{column: "show_description", expected: "showDescription"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.column, func(t *testing.T) {
+			got := archiveKey(test.column)
+			if got != test.expected {
+				t.Errorf("expected: '%s', got: '%s'", test.expected, got)
+			}
+		})
+	}
+}
+
+func Test_blockFileID(t *testing.T) {
+	tests := []struct {
+		description string
+		block       map[string]interface{}
+		expected    string
+	}{{
+		description: "image block should return its file ID",
+		block:       map[string]interface{}{"type": "image", "fields": json.RawMessage(`{"fileId":"7abc.png"}`)},
+		expected:    "7abc.png",
+	}, {
+		description: "block without a file should return nothing",
+		block:       map[string]interface{}{"type": "text", "fields": json.RawMessage(`{}`)},
+	}, {
+		description: "block without fields should return nothing",
+		block:       map[string]interface{}{"type": "text", "fields": nil},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := blockFileID(test.block)
+			if got != test.expected {
+				t.Errorf("expected: '%s', got: '%s'", test.expected, got)
+			}
+		})
+	}
+}
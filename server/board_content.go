@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const BoardsActionKeep = "keep"
+const BoardsActionDelete = "delete"
+const BoardsActionClear = "clear"
+const BoardsActionPlaceholder = "placeholder"
+
+// personPropertyTypes are the card property types whose values are user IDs.
+var personPropertyTypes = map[string]bool{
+	"person":            true,
+	"personNotify":      true,
+	"multiPerson":       true,
+	"multiPersonNotify": true,
+}
+
+// danglingBlockUser matches blocks whose given user column references a user
+// that no longer exists.
+func danglingBlockUser(column string) sq.Sqlizer {
+	return sq.Expr(fmt.Sprintf(`focalboard_blocks.%[1]s NOT IN ('', 'system') AND NOT EXISTS (
+		SELECT 1 FROM Users WHERE Users.id = focalboard_blocks.%[1]s
+	)`, column))
+}
+
+// usesBoardsPlaceholder reports whether any board content is reassigned to
+// the boards placeholder user.
+func (c *configuration) usesBoardsPlaceholder() bool {
+	return c.BoardsAuthorAction == BoardsActionPlaceholder ||
+		c.BoardsCommentAction == BoardsActionPlaceholder ||
+		c.BoardsPersonPropertyAction == BoardsActionPlaceholder
+}
+
+// purgeDanglingBoardContent cleans up the content of shared boards that still
+// references deleted users, as chosen for each content type in the settings.
+// The placeholder user was resolved by the stage's Prepare.
+func purgeDanglingBoardContent(env *cleanupEnv) error {
+	config := env.config
+	placeholderUserID := env.boardsPlaceholderUserID
+
+	switch config.BoardsCommentAction {
+	case BoardsActionKeep:
+	case BoardsActionPlaceholder:
+		if err := remapDanglingBlockAuthors(env.db, placeholderUserID, sq.Eq{"type": "comment"}); err != nil {
+			return fmt.Errorf("error reassigning board comments: %s", err.Error())
+		}
+	default:
+		if err := purgeDanglingBoardComments(env.db); err != nil {
+			return fmt.Errorf("error deleting board comments: %s", err.Error())
+		}
+	}
+
+	if config.BoardsAuthorAction == BoardsActionPlaceholder {
+		if err := remapDanglingBlockAuthors(env.db, placeholderUserID, sq.NotEq{"type": "comment"}); err != nil {
+			return fmt.Errorf("error reassigning board cards and blocks: %s", err.Error())
+		}
+		if err := remapDanglingBoardAuthors(env.db, placeholderUserID); err != nil {
+			return fmt.Errorf("error reassigning boards: %s", err.Error())
+		}
+	}
+
+	switch config.BoardsPersonPropertyAction {
+	case BoardsActionKeep:
+	case BoardsActionPlaceholder:
+		if err := remapDanglingPersonProperties(env, placeholderUserID); err != nil {
+			return fmt.Errorf("error reassigning board person properties: %s", err.Error())
+		}
+	default:
+		if err := remapDanglingPersonProperties(env, ""); err != nil {
+			return fmt.Errorf("error clearing board person properties: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// purgeDanglingBoardComments deletes comments written by deleted users, along
+// with their history.
+func purgeDanglingBoardComments(db *database) error {
+	for {
+		query := sq.Select("id").
+			From("focalboard_blocks").
+			Where(sq.Eq{"type": "comment"}).
+			Where(danglingBlockUser("created_by")).
+			Limit(1000).
+			PlaceholderFormat(db.placeholder())
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the query: %s", err.Error())
+		}
+
+		ids, err := queryIDs(db, queryString, args...)
+		if err != nil {
+			return fmt.Errorf("error when trying to find comments by deleted users: %s", err.Error())
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if err := deleteBlocks(db, ids); err != nil {
+			return err
+		}
+	}
+}
+
+func deleteBlocks(db *database, ids []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
+				rollbackErr.Error(), err.Error())
+		}
+	}()
+
+	deleteBlocksHistoryQuery := sq.Delete("focalboard_blocks_history").
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(db.placeholder())
+
+	deleteBlocksHistoryQueryString, deleteBlocksHistoryArgs, err := deleteBlocksHistoryQuery.ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the delete block history query: %s", err.Error())
+	}
+
+	_, err = tx.Exec(deleteBlocksHistoryQueryString, deleteBlocksHistoryArgs...)
+	if err != nil {
+		return fmt.Errorf("error when trying to delete block history: %s", err.Error())
+	}
+
+	deleteBlocksQuery := sq.Delete("focalboard_blocks").
+		Where(sq.Eq{"id": ids}).
+		PlaceholderFormat(db.placeholder())
+
+	deleteBlocksQueryString, deleteBlocksArgs, err := deleteBlocksQuery.ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the delete blocks query: %s", err.Error())
+	}
+
+	_, err = tx.Exec(deleteBlocksQueryString, deleteBlocksArgs...)
+	if err != nil {
+		return fmt.Errorf("error when trying to delete blocks: %s", err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
+	}
+
+	return nil
+}
+
+// remapDanglingBlockAuthors reassigns the matching blocks created or last
+// modified by deleted users to the placeholder user.
+func remapDanglingBlockAuthors(db *database, placeholderUserID string, blockFilter sq.Sqlizer) error {
+	for _, column := range []string{"created_by", "modified_by"} {
+		query := sq.Update("focalboard_blocks").
+			Set(column, placeholderUserID).
+			Where(blockFilter).
+			Where(danglingBlockUser(column)).
+			PlaceholderFormat(db.placeholder())
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the block %s query: %s", column, err.Error())
+		}
+
+		if _, err := db.Exec(queryString, args...); err != nil {
+			return fmt.Errorf("error when trying to reassign block %s: %s", column, err.Error())
+		}
+	}
+	return nil
+}
+
+// remapDanglingBoardAuthors reassigns boards created or last modified by
+// deleted users to the placeholder user.
+func remapDanglingBoardAuthors(db *database, placeholderUserID string) error {
+	for _, column := range []string{"created_by", "modified_by"} {
+		query := sq.Update("focalboard_boards").
+			Set(column, placeholderUserID).
+			Where(fmt.Sprintf(`focalboard_boards.%[1]s NOT IN ('', 'system') AND NOT EXISTS (
+				SELECT 1 FROM Users WHERE Users.id = focalboard_boards.%[1]s
+			)`, column)).
+			PlaceholderFormat(db.placeholder())
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the board %s query: %s", column, err.Error())
+		}
+
+		if _, err := db.Exec(queryString, args...); err != nil {
+			return fmt.Errorf("error when trying to reassign board %s: %s", column, err.Error())
+		}
+	}
+	return nil
+}
+
+// remapDanglingPersonProperties replaces deleted users in the person
+// properties of every card with the placeholder user, or clears them if no
+// placeholder user is given.
+func remapDanglingPersonProperties(env *cleanupEnv, placeholderUserID string) error {
+	boardProperties, err := getBoardPersonProperties(env.db)
+	if err != nil {
+		return err
+	}
+
+	for boardID, propertyIDs := range boardProperties {
+		cards, err := getCardFields(env.db, boardID)
+		if err != nil {
+			return err
+		}
+
+		var referencedUserIDs []string
+		for _, fields := range cards {
+			referencedUserIDs = append(referencedUserIDs, personPropertyUserIDs(fields, propertyIDs)...)
+		}
+		existingUserIDs, err := getExistingUserIDs(env.db, referencedUserIDs)
+		if err != nil {
+			return err
+		}
+
+		for cardID, fields := range cards {
+			if !remapPersonProperties(fields, propertyIDs, existingUserIDs, placeholderUserID) {
+				continue
+			}
+			if err := updateCardFields(env.db, cardID, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getBoardPersonProperties maps each board ID to the IDs of its person card
+// properties.
+func getBoardPersonProperties(db *database) (map[string]map[string]bool, error) {
+	rows, err := db.Query(`SELECT id, card_properties FROM focalboard_boards;`)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find board card properties: %s", err.Error())
+	}
+	defer rows.Close()
+
+	boardProperties := map[string]map[string]bool{}
+	for rows.Next() {
+		var boardID string
+		var cardProperties []byte
+		if err := rows.Scan(&boardID, &cardProperties); err != nil {
+			return nil, fmt.Errorf("error parsing board card properties: %s", err.Error())
+		}
+
+		var properties []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(cardProperties, &properties); err != nil {
+			return nil, fmt.Errorf("error parsing card properties of board %s: %s", boardID, err.Error())
+		}
+
+		for _, property := range properties {
+			if !personPropertyTypes[property.Type] {
+				continue
+			}
+			if boardProperties[boardID] == nil {
+				boardProperties[boardID] = map[string]bool{}
+			}
+			boardProperties[boardID][property.ID] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to find board card properties: %s", err.Error())
+	}
+
+	return boardProperties, nil
+}
+
+// getCardFields maps each card of the board to its parsed fields.
+func getCardFields(db *database, boardID string) (map[string]map[string]interface{}, error) {
+	query := sq.Select("id", "fields").
+		From("focalboard_blocks").
+		Where(sq.Eq{"board_id": boardID, "type": "card"}).
+		PlaceholderFormat(db.placeholder())
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the card query: %s", err.Error())
+	}
+
+	rows, err := db.Query(queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find cards of board %s: %s", boardID, err.Error())
+	}
+	defer rows.Close()
+
+	cards := map[string]map[string]interface{}{}
+	for rows.Next() {
+		var cardID string
+		var rawFields []byte
+		if err := rows.Scan(&cardID, &rawFields); err != nil {
+			return nil, fmt.Errorf("error parsing cards of board %s: %s", boardID, err.Error())
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(rawFields, &fields); err != nil {
+			return nil, fmt.Errorf("error parsing fields of card %s: %s", cardID, err.Error())
+		}
+		cards[cardID] = fields
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to find cards of board %s: %s", boardID, err.Error())
+	}
+
+	return cards, nil
+}
+
+func updateCardFields(db *database, cardID string, fields map[string]interface{}) error {
+	rawFields, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("error encoding fields of card %s: %s", cardID, err.Error())
+	}
+
+	query := sq.Update("focalboard_blocks").
+		Set("fields", string(rawFields)).
+		Where(sq.Eq{"id": cardID}).
+		PlaceholderFormat(db.placeholder())
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the card update query: %s", err.Error())
+	}
+
+	if _, err := db.Exec(queryString, args...); err != nil {
+		return fmt.Errorf("error when trying to update card %s: %s", cardID, err.Error())
+	}
+	return nil
+}
+
+// personPropertyUserIDs returns the user IDs held by the card's person
+// properties.
+func personPropertyUserIDs(fields map[string]interface{}, propertyIDs map[string]bool) []string {
+	properties, _ := fields["properties"].(map[string]interface{})
+
+	var userIDs []string
+	for propertyID, value := range properties {
+		if !propertyIDs[propertyID] {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			userIDs = append(userIDs, value)
+		case []interface{}:
+			for _, element := range value {
+				if userID, ok := element.(string); ok {
+					userIDs = append(userIDs, userID)
+				}
+			}
+		}
+	}
+	return userIDs
+}
+
+// remapPersonProperties replaces user IDs missing from existingUserIDs in the
+// card's person properties with the placeholder user, or removes them if no
+// placeholder user is given. It reports whether the card changed.
+func remapPersonProperties(fields map[string]interface{}, propertyIDs map[string]bool, existingUserIDs map[string]bool, placeholderUserID string) bool {
+	properties, _ := fields["properties"].(map[string]interface{})
+
+	changed := false
+	for propertyID, value := range properties {
+		if !propertyIDs[propertyID] {
+			continue
+		}
+		switch value := value.(type) {
+		case string:
+			if value == "" || existingUserIDs[value] {
+				continue
+			}
+			changed = true
+			if placeholderUserID == "" {
+				delete(properties, propertyID)
+				continue
+			}
+			properties[propertyID] = placeholderUserID
+		case []interface{}:
+			remapped := []interface{}{}
+			seen := map[string]bool{}
+			for _, element := range value {
+				userID, ok := element.(string)
+				if !ok {
+					remapped = append(remapped, element)
+					continue
+				}
+				if !existingUserIDs[userID] {
+					changed = true
+					if placeholderUserID == "" {
+						continue
+					}
+					userID = placeholderUserID
+				}
+				if seen[userID] {
+					continue
+				}
+				seen[userID] = true
+				remapped = append(remapped, userID)
+			}
+			properties[propertyID] = remapped
+		}
+	}
+	return changed
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_remapPersonProperties(t *testing.T) {
+	tests := []struct {
+		description       string
+		fields            string
+		placeholderUserID string
+		expectedFields    string
+		expectedChanged   bool
+	}{{
+		description:     "existing users are kept",
+		fields:          `{"properties": {"owner": "alive", "watchers": ["alive"]}}`,
+		expectedFields:  `{"properties": {"owner": "alive", "watchers": ["alive"]}}`,
+		expectedChanged: false,
+	}, {
+		description:     "deleted users are cleared",
+		fields:          `{"properties": {"owner": "deleted", "watchers": ["alive", "deleted"]}}`,
+		expectedFields:  `{"properties": {"watchers": ["alive"]}}`,
+		expectedChanged: true,
+	}, {
+		description:       "deleted users are replaced with the placeholder",
+		fields:            `{"properties": {"owner": "deleted", "watchers": ["deleted", "alive"]}}`,
+		placeholderUserID: "placeholder",
+		expectedFields:    `{"properties": {"owner": "placeholder", "watchers": ["placeholder", "alive"]}}`,
+		expectedChanged:   true,
+	}, {
+		description:       "placeholder is not repeated in multi-person properties",
+		fields:            `{"properties": {"watchers": ["deleted", "other-deleted"]}}`,
+		placeholderUserID: "placeholder",
+		expectedFields:    `{"properties": {"watchers": ["placeholder"]}}`,
+		expectedChanged:   true,
+	}, {
+		description:     "other properties are untouched",
+		fields:          `{"properties": {"status": "deleted"}}`,
+		expectedFields:  `{"properties": {"status": "deleted"}}`,
+		expectedChanged: false,
+	}}
+
+	propertyIDs := map[string]bool{"owner": true, "watchers": true}
+	existingUserIDs := map[string]bool{"alive": true}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var fields, expectedFields map[string]interface{}
+			if err := json.Unmarshal([]byte(test.fields), &fields); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.expectedFields), &expectedFields); err != nil {
+				t.Fatal(err)
+			}
+
+			changed := remapPersonProperties(fields, propertyIDs, existingUserIDs, test.placeholderUserID)
+			if changed != test.expectedChanged {
+				t.Errorf("expected changed: '%t', got: '%t'", test.expectedChanged, changed)
+			}
+
+			got, _ := json.Marshal(fields)
+			expected, _ := json.Marshal(expectedFields)
+			if string(got) != string(expected) {
+				t.Errorf("expected: '%s', got: '%s'", expected, got)
+			}
+		})
+	}
+}
@@ -11,7 +11,148 @@ import (
 	"github.com/pkg/errors"
 )
 
-func purgeDanglingBoardMembers(db *sql.DB) error {
+var boardsIntegration = integration{
+	PluginID: "focalboard",
+	Tables: []string{
+		"focalboard_boards",
+		"focalboard_boards_history",
+		"focalboard_board_members",
+		"focalboard_blocks",
+		"focalboard_blocks_history",
+	},
+}
+
+// boardsStage removes deleted users from boards, then deletes the boards
+// that no longer have any members.
+type boardsStage struct{}
+
+func (boardsStage) Name() string {
+	return "boards"
+}
+
+func (boardsStage) IsApplicable(env *cleanupEnv) (bool, string) {
+	return detectIntegration(env, boardsIntegration)
+}
+
+func (boardsStage) DryRunLabel() string {
+	return "boards would be left without members and deleted"
+}
+
+func (boardsStage) DryRunCount(env *cleanupEnv) (int, error) {
+	return countBoardsEmptiedByUsers(env.db, env.userIDs)
+}
+
+func (boardsStage) Prepare(env *cleanupEnv) error {
+	if !env.config.usesBoardsPlaceholder() {
+		return nil
+	}
+	if env.config.BoardsPlaceholderUsername == "" {
+		return fmt.Errorf("a boards placeholder user must be configured")
+	}
+	placeholderUserID, err := resolveReplacementUser(env, "boards placeholder user", env.config.BoardsPlaceholderUsername)
+	if err != nil {
+		return err
+	}
+	env.boardsPlaceholderUserID = placeholderUserID
+	return nil
+}
+
+func (boardsStage) Purge(env *cleanupEnv) error {
+	// Delete board members that no longer exist in the user table
+	if err := purgeDanglingBoardMembers(env.db); err != nil {
+		return fmt.Errorf("error removing users from board members list: %s", err.Error())
+	}
+
+	// Delete boards that have no members
+	if err := purgeEmptyBoards(env); err != nil {
+		return fmt.Errorf("error removing empty boards: %s", err.Error())
+	}
+
+	// Delete the personal boards data of users that no longer exist
+	if err := purgeDanglingBoardUserData(env); err != nil {
+		return fmt.Errorf("error removing boards user data: %s", err.Error())
+	}
+
+	// Clean up content of the remaining boards that references deleted users
+	if err := purgeDanglingBoardContent(env); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (boardsStage) Verify(env *cleanupEnv) ([]userReference, error) {
+	columns := []tableColumn{
+		{"focalboard_board_members", "user_id"},
+		{"focalboard_notification_hints", "modified_by_id"},
+	}
+	for _, data := range danglingBoardUserDataTables {
+		columns = append(columns, tableColumn{data.table, data.column})
+	}
+	// Content authored by deleted users is only expected to be gone if it
+	// was reassigned.
+	if env.config.BoardsAuthorAction == BoardsActionPlaceholder {
+		columns = append(columns,
+			tableColumn{"focalboard_boards", "created_by"},
+			tableColumn{"focalboard_boards", "modified_by"},
+			tableColumn{"focalboard_blocks", "created_by"},
+			tableColumn{"focalboard_blocks", "modified_by"},
+		)
+	}
+	return verifyTableColumns(env, columns)
+}
+
+// boardMemberships are the members of a board.
+var boardMemberships = []membership{
+	{Table: "focalboard_board_members", ContainerColumn: "board_id", UserColumn: "user_id", PermanentMembers: []string{"system"}},
+}
+
+// countBoardsEmptiedByUsers counts the boards that would have no members left
+// once the given users are deleted, including boards already without members.
+func countBoardsEmptiedByUsers(db *database, userIDs []string) (int, error) {
+	remainingMembersQuery := sq.Select("1").
+		From("focalboard_board_members").
+		Where("focalboard_board_members.board_id = focalboard_boards.id").
+		Where(sq.Or{
+			sq.Eq{"focalboard_board_members.user_id": "system"},
+			sq.Expr("EXISTS (SELECT 1 FROM Users WHERE Users.id = focalboard_board_members.user_id)"),
+		})
+
+	remainingMembersQueryString, remainingMembersArgs, err := remainingMembersQuery.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to build the remaining board members query: %s", err.Error())
+	}
+
+	countQuery := sq.Select("COUNT(*)").
+		From("focalboard_boards").
+		Where(sq.Expr("NOT EXISTS ("+remainingMembersQueryString+")", remainingMembersArgs...)).
+		PlaceholderFormat(db.placeholder())
+
+	countQueryString, countArgs, err := countQuery.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to build the empty boards count query: %s", err.Error())
+	}
+
+	var count int
+	if err := db.QueryRow(countQueryString, countArgs...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error when trying to count boards without members: %s", err.Error())
+	}
+
+	// Boards whose members are all among the users are emptied by deleting
+	// them. Boards without existing members are already counted above.
+	left, err := findContainersLeftByUsers(db, boardMemberships, userIDs)
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to count boards emptied by users: %s", err.Error())
+	}
+	for _, members := range left {
+		if members > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func purgeDanglingBoardMembers(db *database) error {
 	_, err := db.Exec(`
 			DELETE FROM focalboard_board_members
 			  WHERE NOT EXISTS (
@@ -26,8 +167,81 @@ func purgeDanglingBoardMembers(db *sql.DB) error {
 	return nil
 }
 
-func purgeEmptyBoards(db *sql.DB, pluginClient *pluginapi.Client) error {
-	rows, err := db.Query(`
+// danglingBoardUserDataTables lists the boards tables with per-user rows
+// beyond board membership. Tables missing from the installed boards version
+// are skipped.
+var danglingBoardUserDataTables = []struct {
+	table  string
+	column string
+}{
+	{"focalboard_board_members_history", "user_id"},
+	{"focalboard_preferences", "userid"},
+	{"focalboard_subscriptions", "subscriber_id"},
+	{"focalboard_sessions", "user_id"},
+	{"focalboard_categories", "user_id"},
+}
+
+func purgeDanglingBoardUserData(env *cleanupEnv) error {
+	for _, data := range danglingBoardUserDataTables {
+		if _, ok := env.tables[data.table]; !ok {
+			continue
+		}
+
+		_, err := env.db.Exec(fmt.Sprintf(`
+			DELETE FROM %[1]s
+			  WHERE NOT EXISTS (
+			    SELECT 1
+			    FROM Users
+			      WHERE Users.id = %[1]s.%[2]s
+			  ) AND NOT %[1]s.%[2]s = 'system';
+		`, data.table, data.column))
+		if err != nil {
+			return fmt.Errorf("error when trying to delete from %s: %s", data.table, err.Error())
+		}
+	}
+
+	// A notification hint holds the pending notifications of every watcher
+	// of a block, so only its last modifier is cleared.
+	if _, ok := env.tables["focalboard_notification_hints"]; ok {
+		_, err := env.db.Exec(`
+			UPDATE focalboard_notification_hints
+			  SET modified_by_id = ''
+			  WHERE NOT EXISTS (
+			    SELECT 1
+			    FROM Users
+			      WHERE Users.id = focalboard_notification_hints.modified_by_id
+			  ) AND focalboard_notification_hints.modified_by_id NOT IN ('', 'system');
+		`)
+		if err != nil {
+			return fmt.Errorf("error when trying to update focalboard_notification_hints: %s", err.Error())
+		}
+	}
+
+	// Removing the categories of deleted users, and the empty boards
+	// deleted earlier, leaves behind their category entries.
+	if _, ok := env.tables["focalboard_category_boards"]; ok {
+		_, err := env.db.Exec(`
+			DELETE FROM focalboard_category_boards
+			  WHERE NOT EXISTS (
+			    SELECT 1
+			    FROM focalboard_categories
+			      WHERE focalboard_categories.id = focalboard_category_boards.category_id
+			  ) OR NOT EXISTS (
+			    SELECT 1
+			    FROM focalboard_boards
+			      WHERE focalboard_boards.id = focalboard_category_boards.board_id
+			  );
+		`)
+		if err != nil {
+			return fmt.Errorf("error when trying to delete from focalboard_category_boards: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func purgeEmptyBoards(env *cleanupEnv) error {
+	rows, err := env.db.Query(`
 			SELECT id FROM focalboard_boards
 			  WHERE NOT EXISTS (
 			    SELECT 1
@@ -50,7 +264,15 @@ func purgeEmptyBoards(db *sql.DB, pluginClient *pluginapi.Client) error {
 	}
 
 	for _, id := range ids {
-		err = deleteBoard(db, pluginClient, id)
+		// Memberless boards can still hold content a team later asks for,
+		// so archive them first if configured to.
+		if env.config.ArchiveBoardsBeforeDeletion {
+			if err = archiveBoard(env, id); err != nil {
+				return fmt.Errorf("error archiving board %s: %s", id, err.Error())
+			}
+		}
+
+		err = deleteBoard(env.db, env.pluginClient, id)
 		if err != nil {
 			return fmt.Errorf("error deleting board: %s", err.Error())
 		}
@@ -58,7 +280,7 @@ func purgeEmptyBoards(db *sql.DB, pluginClient *pluginapi.Client) error {
 	return nil
 }
 
-func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (err error) {
+func deleteBoard(db *database, pluginClient *pluginapi.Client, boardID string) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
@@ -72,7 +294,7 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 
 	blockDeleteQuery := sq.Delete("focalboard_blocks").
 		Where(sq.Eq{"board_id": boardID}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	blockDeleteQueryString, blockDeleteQueryArgs, err := blockDeleteQuery.ToSql()
 	if err != nil {
@@ -86,7 +308,7 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 
 	deleteBlocksHistoryQuery := sq.Delete("focalboard_blocks_history").
 		Where(sq.Eq{"board_id": boardID}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	deleteBlockHistoryQueryString, deleteBlockHistoryArgs, err := deleteBlocksHistoryQuery.ToSql()
 	if err != nil {
@@ -100,7 +322,7 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 
 	boardDeleteQuery := sq.Delete("focalboard_boards").
 		Where(sq.Eq{"id": boardID}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	boardDeleteQueryString, boardDeleteQueryArgs, err := boardDeleteQuery.ToSql()
 	if err != nil {
@@ -114,7 +336,7 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 
 	deleteBoardsHistoryQuery := sq.Delete("focalboard_boards_history").
 		Where(sq.Eq{"id": boardID}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	deleteBoardsHistoryQueryString, deleteBoardsHistoryArgs, err := deleteBoardsHistoryQuery.ToSql()
 	if err != nil {
@@ -126,15 +348,16 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 		return fmt.Errorf("error when trying to delete board history: %s", err.Error())
 	}
 
-	fileInfosToDelete, err := tx.Query(`
-		SELECT id, path FROM fileinfo
+	fileID := db.jsonText("fields", "fileId")
+	fileInfosToDelete, err := tx.Query(fmt.Sprintf(`
+		SELECT id, path FROM FileInfo
 		WHERE creatorid = 'boards' AND
 		    NOT EXISTS (
 		        SELECT 1 FROM focalboard_blocks
-		        WHERE NOT fields->>'fileId' = '' AND
-                            fileinfo.path LIKE CONCAT('%', fields->>'fileId')
+		        WHERE NOT %s = '' AND
+		            FileInfo.path LIKE CONCAT('%%', %s)
 		    );
-	`)
+	`, fileID, fileID))
 	if err != nil {
 		return fmt.Errorf("error when trying to find board files: %s", err.Error())
 	}
@@ -168,9 +391,9 @@ func deleteBoard(db *sql.DB, pluginClient *pluginapi.Client, boardID string) (er
 		}
 	}
 
-	deleteFileInfosQuery := sq.Delete("fileinfo").
+	deleteFileInfosQuery := sq.Delete("FileInfo").
 		Where(sq.Eq{"id": fileInfoIDs}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	deleteFileInfosQueryString, deleteFileInfosArgs, err := deleteFileInfosQuery.ToSql()
 	if err != nil {
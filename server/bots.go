@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+const botListPageSize = 200
+
+// selectStaleBots returns the bots whose owner was deleted or deactivated,
+// or that haven't posted in inactivityDays. owners maps each owner ID to the
+// owner, or to nil if the owner no longer exists. Bots that never posted are
+// measured from their creation. Bots owned by plugins are never selected.
+func selectStaleBots(bots []*model.Bot, owners map[string]*model.User, lastPost map[string]int64, now time.Time, inactivityDays int) []*model.Bot {
+	cutoff := model.GetMillisForTime(now.Add(-time.Duration(inactivityDays) * 24 * time.Hour))
+
+	var stale []*model.Bot
+	for _, bot := range bots {
+		// Plugins own their bots by plugin ID rather than by user ID
+		if !model.IsValidId(bot.OwnerId) {
+			continue
+		}
+
+		if owner, ok := owners[bot.OwnerId]; ok && (owner == nil || owner.DeleteAt != 0) {
+			stale = append(stale, bot)
+			continue
+		}
+
+		if inactivityDays <= 0 {
+			continue
+		}
+		lastActive, ok := lastPost[bot.UserId]
+		if !ok {
+			lastActive = bot.CreateAt
+		}
+		if lastActive <= cutoff {
+			stale = append(stale, bot)
+		}
+	}
+	return stale
+}
+
+// getStaleBots returns the user IDs of the bots that should be cleaned up.
+func (p *Plugin) getStaleBots() ([]string, error) {
+	bots, err := listBots(p.pluginClient)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := map[string]*model.User{}
+	for _, bot := range bots {
+		if !model.IsValidId(bot.OwnerId) {
+			continue
+		}
+		if _, ok := owners[bot.OwnerId]; ok {
+			continue
+		}
+		owner, err := p.pluginClient.User.Get(bot.OwnerId)
+		if err == pluginapi.ErrNotFound {
+			owners[bot.OwnerId] = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to get bot owner %s: %s", bot.OwnerId, err.Error())
+		}
+		owners[bot.OwnerId] = owner
+	}
+
+	db, err := getDatabase(p.pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing database: %s", err.Error())
+	}
+	botUserIDs := make([]string, 0, len(bots))
+	for _, bot := range bots {
+		botUserIDs = append(botUserIDs, bot.UserId)
+	}
+	lastPost, err := getLastPostTimes(db, botUserIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var userIDs []string
+	for _, bot := range selectStaleBots(bots, owners, lastPost, time.Now(), p.getConfiguration().BotInactivityDays) {
+		userIDs = append(userIDs, bot.UserId)
+	}
+	return userIDs, nil
+}
+
+// listBots returns every bot, including deactivated ones.
+func listBots(client *pluginapi.Client) ([]*model.Bot, error) {
+	var bots []*model.Bot
+	for page := 0; ; page++ {
+		botPage, err := client.Bot.List(page, botListPageSize, pluginapi.BotIncludeDeleted())
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to list bots: %s", err.Error())
+		}
+		bots = append(bots, botPage...)
+		if len(botPage) < botListPageSize {
+			return bots, nil
+		}
+	}
+}
+
+// getLastPostTimes returns when each of the given users last posted. Users
+// that never posted are left out.
+func getLastPostTimes(db *database, userIDs []string) (map[string]int64, error) {
+	lastPost := map[string]int64{}
+	for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+		end := start + userIDLookupBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		queryString, args, err := sq.Select("UserId", "MAX(CreateAt)").
+			From("Posts").
+			Where(sq.Eq{"UserId": userIDs[start:end]}).
+			GroupBy("UserId").
+			PlaceholderFormat(db.placeholder()).
+			ToSql()
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to build the last post query: %s", err.Error())
+		}
+
+		rows, err := db.Query(queryString, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to find last posts: %s", err.Error())
+		}
+		for rows.Next() {
+			var userID string
+			var createAt int64
+			if err = rows.Scan(&userID, &createAt); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error when scanning row: %s", err.Error())
+			}
+			lastPost[userID] = createAt
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to find last posts: %s", err.Error())
+		}
+	}
+	return lastPost, nil
+}
+
+// purgeBot revokes a bot's access tokens and permanently deletes the bot
+// along with its user. Its posts are left for purgeDanglingUserPosts.
+func purgeBot(db *database, pluginClient *pluginapi.Client, botUserID string) error {
+	bot, err := pluginClient.Bot.Get(botUserID, true)
+	if err != nil {
+		return fmt.Errorf("error when trying to get bot: %s", err.Error())
+	}
+	if !model.IsValidId(bot.OwnerId) {
+		return fmt.Errorf("bot @%s is owned by plugin %s and can't be deleted", bot.Username, bot.OwnerId)
+	}
+
+	queryString, args, err := sq.Select("Id").
+		From("UserAccessTokens").
+		Where(sq.Eq{"UserId": botUserID}).
+		PlaceholderFormat(db.placeholder()).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the access tokens query: %s", err.Error())
+	}
+	tokenIDs, err := queryIDs(db, queryString, args...)
+	if err != nil {
+		return fmt.Errorf("error when trying to find bot access tokens: %s", err.Error())
+	}
+	for _, tokenID := range tokenIDs {
+		if err = pluginClient.User.RevokeAccessToken(tokenID); err != nil {
+			return fmt.Errorf("error when trying to revoke bot access token %s: %s", tokenID, err.Error())
+		}
+	}
+
+	if err = pluginClient.Bot.DeletePermanently(botUserID); err != nil {
+		return fmt.Errorf("error when trying to delete bot: %s", err.Error())
+	}
+	return nil
+}
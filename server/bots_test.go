@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_selectStaleBots(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return model.GetMillisForTime(now.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+
+	activeOwner := &model.User{Id: model.NewId()}
+	deactivatedOwner := &model.User{Id: model.NewId(), DeleteAt: daysAgo(1)}
+	deletedOwnerID := model.NewId()
+	owners := map[string]*model.User{
+		activeOwner.Id:      activeOwner,
+		deactivatedOwner.Id: deactivatedOwner,
+		deletedOwnerID:      nil,
+	}
+
+	tests := []struct {
+		description string
+		bot         model.Bot
+		lastPost    int64
+		expected    bool
+	}{{
+		description: "bot with a deleted owner should be selected",
+		bot:         model.Bot{OwnerId: deletedOwnerID, CreateAt: daysAgo(200)},
+		lastPost:    daysAgo(1),
+		expected:    true,
+	}, {
+		description: "bot with a deactivated owner should be selected",
+		bot:         model.Bot{OwnerId: deactivatedOwner.Id, CreateAt: daysAgo(200)},
+		lastPost:    daysAgo(1),
+		expected:    true,
+	}, {
+		description: "bot that hasn't posted within the inactivity period should be selected",
+		bot:         model.Bot{OwnerId: activeOwner.Id, CreateAt: daysAgo(200)},
+		lastPost:    daysAgo(91),
+		expected:    true,
+	}, {
+		description: "bot that posted recently should not be selected",
+		bot:         model.Bot{OwnerId: activeOwner.Id, CreateAt: daysAgo(200)},
+		lastPost:    daysAgo(10),
+	}, {
+		description: "old bot that never posted should be selected",
+		bot:         model.Bot{OwnerId: activeOwner.Id, CreateAt: daysAgo(200)},
+		expected:    true,
+	}, {
+		description: "new bot that never posted should not be selected",
+		bot:         model.Bot{OwnerId: activeOwner.Id, CreateAt: daysAgo(10)},
+	}, {
+		description: "inactive plugin bot should not be selected",
+		bot:         model.Bot{OwnerId: "com.mattermost.plugin-example", CreateAt: daysAgo(200)},
+		lastPost:    daysAgo(91),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			test.bot.UserId = model.NewId()
+			lastPost := map[string]int64{}
+			if test.lastPost != 0 {
+				lastPost[test.bot.UserId] = test.lastPost
+			}
+
+			got := len(selectStaleBots([]*model.Bot{&test.bot}, owners, lastPost, now, 90)) == 1
+			if got != test.expected {
+				t.Errorf("expected: '%t', got: '%t'", test.expected, got)
+			}
+		})
+	}
+}
@@ -12,30 +12,102 @@ import (
 
 const Trigger = "bulk-user-delete"
 const Usage = "[mode] [target users]"
+const FilterUsage = "[mode] filter [expression]"
+const VerifyUsage = "verify [job ID]"
+const RequestDeletionUsage = "request-my-deletion [confirm | cancel]"
+const ApproveRequestsUsage = "approve [user ID | all]"
+const ProfileUsage = "profile [create | list | show | delete] [name] [document]"
 
 const ModeDryRun = "dry-run"
 const ModeLive = "live"
+const ModeVerify = "verify"
+const ModeStage = "stage"
+const ModeRequestDeletion = "request-my-deletion"
+const ModeListRequests = "requests"
+const ModeApproveRequests = "approve"
+const ModeProfile = "profile"
+
+const RequestConfirm = "confirm"
+const RequestCancel = "cancel"
 
 const UsersInactive = "inactive"
 const UsersAll = "all"
+const UsersLDAP = "ldap"
+const UsersGuests = "guests"
+const UsersBots = "bots"
+const UsersFilter = "filter"
 
 func registerSlashCommand(client *pluginapi.Client) error {
-	autocompleteData := model.NewAutocompleteData(Trigger, Usage, "")
-	autocompleteData.RoleID = model.SystemAdminRoleId
-	autocompleteData.AddStaticListArgument("mode", true, []model.AutocompleteListItem{{
-		Item:     ModeDryRun,
-		HelpText: "Simulate a bulk deletion. This will not change any data.",
-	}, {
-		Item:     ModeLive,
-		HelpText: "Perform a bulk deletion. This will change data.",
-	}})
-	autocompleteData.AddStaticListArgument("target users", true, []model.AutocompleteListItem{{
+	targetUsers := []model.AutocompleteListItem{{
 		Item:     UsersInactive,
 		HelpText: "Only delete matching inactive users.",
 	}, {
 		Item:     UsersAll,
 		HelpText: "Delete all matching users.",
+	}, {
+		Item:     UsersLDAP,
+		HelpText: "Delete LDAP users deactivated by LDAP sync, once the LDAP deletion delay has passed.",
+	}, {
+		Item:     UsersGuests,
+		HelpText: "Delete matching guests who are inactive, deactivated or in no channels.",
+	}, {
+		Item:     UsersBots,
+		HelpText: "Delete bots whose owner is gone, or that haven't posted recently.",
+	}, {
+		Item:     UsersFilter,
+		HelpText: "Delete the users matching a filter expression, or the configured filter expression.",
+	}}
+
+	dryRun := model.NewAutocompleteData(ModeDryRun, "[target users]", "Simulate a bulk deletion. This will not change any data.")
+	dryRun.AddStaticListArgument("target users", true, targetUsers)
+	dryRun.AddNamedTextArgument("", "Filter expression, for the filter target users", "[expression]", "", false)
+
+	live := model.NewAutocompleteData(ModeLive, "[target users]", "Perform a bulk deletion. This will change data.")
+	live.AddStaticListArgument("target users", true, targetUsers)
+	live.AddNamedTextArgument("", "Filter expression, for the filter target users", "[expression]", "", false)
+
+	stage := model.NewAutocompleteData(ModeStage, "[target users]", "Deactivate matching users now, and permanently delete them once the grace period has passed.")
+	stage.AddStaticListArgument("target users", true, targetUsers)
+	stage.AddNamedTextArgument("", "Filter expression, for the filter target users", "[expression]", "", false)
+
+	verify := model.NewAutocompleteData(ModeVerify, "[job ID]", "Check that no data remains for the users deleted by a job.")
+	verify.AddTextArgument("ID of the job to verify", "[job ID]", "")
+
+	listRequests := model.NewAutocompleteData(ModeListRequests, "", "List the pending account deletion requests.")
+
+	approveRequests := model.NewAutocompleteData(ModeApproveRequests, "[user ID | all]", "Delete the users who requested deletion of their account.")
+	approveRequests.AddTextArgument("ID of the requesting user, or all", "[user ID | all]", "")
+
+	profile := model.NewAutocompleteData(ModeProfile, "[create | list | show | delete]", "Manage the named cleanup profiles run with the profile:[name] target users.")
+	createProfile := model.NewAutocompleteData(ProfileCreate, "[name] [document]", "Create a profile from a YAML or JSON document.")
+	createProfile.AddTextArgument("Name of the profile", "[name]", "")
+	createProfile.AddTextArgument("YAML or JSON document with the profile's filters and options", "[document]", "")
+	showProfile := model.NewAutocompleteData(ProfileShow, "[name]", "Show a profile.")
+	showProfile.AddTextArgument("Name of the profile", "[name]", "")
+	deleteProfile := model.NewAutocompleteData(ProfileDelete, "[name]", "Delete a profile.")
+	deleteProfile.AddTextArgument("Name of the profile", "[name]", "")
+	profile.AddCommand(createProfile)
+	profile.AddCommand(model.NewAutocompleteData(ProfileList, "", "List the profiles."))
+	profile.AddCommand(showProfile)
+	profile.AddCommand(deleteProfile)
+
+	requestDeletion := model.NewAutocompleteData(ModeRequestDeletion, "[confirm | cancel]", "Request permanent deletion of your account.")
+	requestDeletion.AddStaticListArgument("confirm or cancel", false, []model.AutocompleteListItem{{
+		Item:     RequestConfirm,
+		HelpText: "Confirm that your account should be deleted.",
+	}, {
+		Item:     RequestCancel,
+		HelpText: "Cancel your pending deletion request.",
 	}})
+
+	// Every user can request their own deletion. The other commands are
+	// only offered to system administrators.
+	autocompleteData := model.NewAutocompleteData(Trigger, Usage, "")
+	for _, adminCommand := range []*model.AutocompleteData{dryRun, live, stage, verify, listRequests, approveRequests, profile} {
+		adminCommand.RoleID = model.SystemAdminRoleId
+		autocompleteData.AddCommand(adminCommand)
+	}
+	autocompleteData.AddCommand(requestDeletion)
 	return client.SlashCommand.Register(&model.Command{
 		Trigger:          Trigger,
 		AutoComplete:     true,
@@ -56,17 +128,88 @@ func validateUser(client *pluginapi.Client, userid string) error {
 
 func validateCommand(command string) error {
 	fields := strings.Fields(command)
-	if len(fields) != 3 {
+	if len(fields) < 2 {
 		return fmt.Errorf("missing argument. Usage: %s /%s", Trigger, Usage)
 	}
 	if fields[0] != "/"+Trigger {
 		return fmt.Errorf("invalid command. Usage: %s /%s", Trigger, Usage)
 	}
-	if fields[1] != ModeDryRun && fields[1] != ModeLive {
-		return fmt.Errorf("invalid mode. Must be '%s' or '%s'", ModeDryRun, ModeLive)
+	switch fields[1] {
+	case ModeRequestDeletion:
+		if len(fields) == 2 || (len(fields) == 3 && (fields[2] == RequestConfirm || fields[2] == RequestCancel)) {
+			return nil
+		}
+		return fmt.Errorf("invalid argument. Usage: /%s %s", Trigger, RequestDeletionUsage)
+	case ModeListRequests:
+		if len(fields) != 2 {
+			return fmt.Errorf("unexpected argument. Usage: /%s %s", Trigger, ModeListRequests)
+		}
+		return nil
+	case ModeProfile:
+		return validateProfileCommand(fields)
+	}
+	// Only a filter expression can span several fields
+	if len(fields) != 3 && !(len(fields) > 3 && fields[2] == UsersFilter) {
+		return fmt.Errorf("missing argument. Usage: %s /%s", Trigger, Usage)
+	}
+	if fields[1] == ModeApproveRequests {
+		if fields[2] != UsersAll && !model.IsValidId(fields[2]) {
+			return fmt.Errorf("invalid user ID. Usage: /%s %s", Trigger, ApproveRequestsUsage)
+		}
+		return nil
+	}
+	if fields[1] == ModeVerify {
+		if !model.IsValidId(fields[2]) {
+			return fmt.Errorf("invalid job ID. Usage: /%s %s", Trigger, VerifyUsage)
+		}
+		return nil
+	}
+	if fields[1] != ModeDryRun && fields[1] != ModeLive && fields[1] != ModeStage {
+		return fmt.Errorf("invalid mode. Must be '%s', '%s', '%s', '%s', '%s', '%s', '%s' or '%s'",
+			ModeDryRun, ModeLive, ModeStage, ModeVerify, ModeListRequests, ModeApproveRequests, ModeProfile, ModeRequestDeletion)
+	}
+	if name, ok := strings.CutPrefix(fields[2], ProfileTargetPrefix); ok {
+		if !profileNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid profile name '%s'", name)
+		}
+		return nil
+	}
+	if fields[2] != UsersInactive && fields[2] != UsersAll && fields[2] != UsersLDAP && fields[2] != UsersGuests && fields[2] != UsersBots && fields[2] != UsersFilter {
+		return fmt.Errorf("invalid target users. Must be '%s', '%s', '%s', '%s', '%s', '%s' or '%s[name]'",
+			UsersInactive, UsersAll, UsersLDAP, UsersGuests, UsersBots, UsersFilter, ProfileTargetPrefix)
+	}
+	if fields[2] == UsersFilter && len(fields) > 3 {
+		expression, offset := commandRemainder(command, 3)
+		if _, err := parseFilter(expression); err != nil {
+			return fmt.Errorf("%s\nUsage: /%s %s", describeFilterError(command, offset, err), Trigger, FilterUsage)
+		}
+	}
+	return nil
+}
+
+func validateProfileCommand(fields []string) error {
+	if len(fields) < 3 {
+		return fmt.Errorf("missing argument. Usage: /%s %s", Trigger, ProfileUsage)
+	}
+	switch fields[2] {
+	case ProfileList:
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected argument. Usage: /%s %s %s", Trigger, ModeProfile, ProfileList)
+		}
+		return nil
+	case ProfileCreate:
+		if len(fields) < 5 {
+			return fmt.Errorf("missing argument. Usage: /%s %s %s [name] [document]", Trigger, ModeProfile, ProfileCreate)
+		}
+	case ProfileShow, ProfileDelete:
+		if len(fields) != 4 {
+			return fmt.Errorf("invalid argument. Usage: /%s %s %s [name]", Trigger, ModeProfile, fields[2])
+		}
+	default:
+		return fmt.Errorf("invalid profile command. Usage: /%s %s", Trigger, ProfileUsage)
 	}
-	if fields[2] != UsersInactive && fields[2] != UsersAll {
-		return fmt.Errorf("invalid target users. Must be '%s' or '%s'", UsersInactive, UsersAll)
+	if !profileNamePattern.MatchString(fields[3]) {
+		return fmt.Errorf("invalid profile name '%s'. Use lowercase letters, digits, '-' and '_'", fields[3])
 	}
 	return nil
 }
@@ -74,11 +217,17 @@ func validateCommand(command string) error {
 func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
 	p.pluginClient.Log.Info("Bulk user deletion triggered", "user", args.UserId, "command", args.Command)
 
-	if err := validateUser(p.pluginClient, args.UserId); err != nil {
-		return &model.CommandResponse{
-			ResponseType: model.CommandResponseTypeEphemeral,
-			Text:         err.Error(),
-		}, nil
+	fields := strings.Fields(args.Command)
+	selfService := len(fields) > 1 && fields[1] == ModeRequestDeletion
+
+	// Any user can request their own deletion
+	if !selfService {
+		if err := validateUser(p.pluginClient, args.UserId); err != nil {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         err.Error(),
+			}, nil
+		}
 	}
 
 	if err := validateCommand(args.Command); err != nil {
@@ -88,11 +237,41 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 		}, nil
 	}
 
-	fields := strings.Fields(args.Command)
+	switch fields[1] {
+	case ModeRequestDeletion:
+		if len(fields) == 3 && fields[2] == RequestCancel {
+			return p.executeCancelDeletionCommand(args), nil
+		}
+		return p.executeRequestDeletionCommand(args, len(fields) == 3), nil
+	case ModeListRequests:
+		return p.executeListRequestsCommand(), nil
+	case ModeApproveRequests:
+		return p.executeApproveRequestsCommand(args, fields[2]), nil
+	case ModeVerify:
+		return p.executeVerifyCommand(args, fields[2]), nil
+	case ModeProfile:
+		return p.executeProfileCommand(args, fields), nil
+	}
+
 	dryRun := fields[1] == ModeDryRun
-	targetInactiveUsersOnly := fields[2] == UsersInactive
 
-	users, err := getUsers(p.pluginClient, targetInactiveUsersOnly)
+	var profile *cleanupProfile
+	var userIDs []string
+	var err error
+	if profileName, ok := strings.CutPrefix(fields[2], ProfileTargetPrefix); ok {
+		if profile, err = getProfile(p.pluginClient, profileName); err == nil && profile == nil {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         fmt.Sprintf("No profile found named `%s`", profileName),
+			}, nil
+		}
+		if err == nil {
+			userIDs, err = p.selectProfileUsers(profile)
+		}
+	} else {
+		filterExpression, _ := commandRemainder(args.Command, 3)
+		userIDs, err = p.selectTargetUsers(fields[2], filterExpression)
+	}
 	if err != nil {
 		return &model.CommandResponse{
 			ResponseType: model.CommandResponseTypeEphemeral,
@@ -100,33 +279,68 @@ func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*mo
 		}, nil
 	}
 
-	config := p.getConfiguration()
-	usersToDelete := filterForUsersByEmails(p.pluginClient, users, config.TargetEmailAddressSuffixes(), config.TargetEmailAddresses())
+	// A profile's report channel gets the job's status post.
+	reportChannelID := args.ChannelId
+	if profile != nil && profile.ReportChannelID != "" {
+		reportChannelID = profile.ReportChannelID
+	}
 
-	var userListFileID string
-	if len(usersToDelete) > 0 {
-		var userList strings.Builder
-		for _, user := range usersToDelete {
-			fmt.Fprintf(&userList, "%s, ", user.Email)
-		}
-		userListString := strings.TrimSuffix(userList.String(), ", ")
+	// Only the target user IDs are selected here, so the command returns
+	// quickly. The job attaches the list of their emails to its status post.
+	userListName := fmt.Sprintf("%d-target-users-bulk-delete-%s-%s.txt", time.Now().Unix(), fields[1], strings.ReplaceAll(fields[2], ":", "-"))
 
-		userListFileInfo, err := p.pluginClient.File.Upload(strings.NewReader(userListString),
-			fmt.Sprintf("%d-target-users-bulk-delete-%s-%s.txt", time.Now().Unix(), fields[1], fields[2]), args.ChannelId)
-		if err != nil {
-			return &model.CommandResponse{
-				ResponseType: model.CommandResponseTypeEphemeral,
-				Text:         fmt.Sprintf("Unable to upload list of target users: %s", err.Error()),
-			}, nil
-		}
+	if fields[1] == ModeStage {
+		go p.runStageJob(args.UserId, reportChannelID, userIDs, userListName, profile)
 
-		userListFileID = userListFileInfo.Id
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Starting bulk user staging job for %d users with command: `%s`", len(userIDs), args.Command),
+		}, nil
 	}
 
-	go p.runBulkDeleteJob(dryRun, args.UserId, args.ChannelId, usersToDelete, userListFileID)
+	go p.runProfileJob(profile, dryRun, args.UserId, reportChannelID, userIDs, userListName)
 
 	return &model.CommandResponse{
 		ResponseType: model.CommandResponseTypeEphemeral,
-		Text:         fmt.Sprintf("Starting bulk user deletion job with command: `%s`", args.Command),
+		Text:         fmt.Sprintf("Starting bulk user deletion job for %d users with command: `%s`", len(userIDs), args.Command),
 	}, nil
 }
+
+func (p *Plugin) executeVerifyCommand(args *model.CommandArgs, jobID string) *model.CommandResponse {
+	deletionJob, err := getJob(p.pluginClient, jobID)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to retrieve job: %s", err.Error()),
+		}
+	}
+	if deletionJob == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("No bulk user deletion job found with ID `%s`", jobID),
+		}
+	}
+	// The running key is stored in the KV store and survives restarts, but
+	// OnActivate clears it. A job still marked as running while the key is
+	// clear was interrupted by a restart, so it can be verified.
+	var running bool
+	if err = p.pluginClient.KV.Get(RunningKey, &running); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to determine if a bulk delete job is running: %s", err.Error()),
+		}
+	}
+	if deletionJob.Status == JobStatusRunning && running {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Bulk user deletion job `%s` is still running", jobID),
+		}
+	}
+
+	go p.runVerifyJob(args.UserId, args.ChannelId, deletionJob)
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Verifying bulk user deletion job `%s`", jobID),
+	}
+}
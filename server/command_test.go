@@ -47,6 +47,105 @@ func Test_validateCommand(t *testing.T) {
 	}, {
 		command:   "/bulk-user-delete live all",
 		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete stage",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete stage bazz",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete stage inactive",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete dry-run ldap",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete live guests",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete dry-run bots",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete live filter",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete live profile:contractors",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete dry-run profile:Bad*Name",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete profile list",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete profile list extra",
+		expectErr: true,
+	}, {
+		command:   `/bulk-user-delete profile create contractors {"email_suffixes": ["@contractor.example.com"]}`,
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete profile create contractors",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete profile show contractors",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete profile delete",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete profile rename contractors",
+		expectErr: true,
+	}, {
+		command:   `/bulk-user-delete dry-run filter auth=saml AND email~"@old\.example\.com$" AND NOT team:core`,
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete dry-run filter auth=saml AND",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete dry-run inactive extra",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete verify",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete verify bazz",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete verify 4xp9fdt77pncbef59f4k1qe83o",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete request-my-deletion",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete request-my-deletion confirm",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete request-my-deletion cancel",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete request-my-deletion confirm cancel",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete request-my-deletion bazz",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete requests",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete requests bazz",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete approve",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete approve bazz",
+		expectErr: true,
+	}, {
+		command:   "/bulk-user-delete approve all",
+		expectErr: false,
+	}, {
+		command:   "/bulk-user-delete approve 4xp9fdt77pncbef59f4k1qe83o",
+		expectErr: false,
 	}}
 
 	for _, test := range tests {
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/pkg/errors"
 )
 
@@ -19,9 +21,43 @@ import (
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	TargetInactiveUsersOnly       bool
-	TargetEmailAddressSuffixesCSV string
-	TargetEmailAddressesCSV       string
+	TargetInactiveUsersOnly              bool
+	TargetEmailAddressSuffixesCSV        string
+	TargetEmailAddressesCSV              string
+	VerifyWithSchemaScan                 bool
+	DisabledCleanupStagesCSV             string
+	PluginHookTimeoutSeconds             int
+	CustomCleanupRules                   string
+	BoardsAuthorAction                   string
+	BoardsCommentAction                  string
+	BoardsPersonPropertyAction           string
+	BoardsPlaceholderUsername            string
+	ArchiveBoardsBeforeDeletion          bool
+	BoardArchiveDirectory                string
+	PlaybooksFallbackUsername            string
+	ExportUsersBeforeDeletion            bool
+	UserExportDirectory                  string
+	UserExportChannelID                  string
+	UserExportPublicKey                  string
+	AllowUnencryptedExportUploads        bool
+	DeletionGracePeriodDays              int
+	NotifyStagedUsers                    bool
+	NoticeTemplate                       string
+	NoticeContestURL                     string
+	DeletionRequestsChannelID            string
+	ApproveDeletionRequestsAutomatically bool
+	DeletionRequestWaitingHours          int
+	LDAPDeletionDelayDays                int
+	ScheduleLDAPDeletion                 bool
+	ScheduledJobsChannelID               string
+	GuestExpiryDays                      int
+	ScheduleGuestCleanup                 bool
+	BotInactivityDays                    int
+	FilterExpression                     string
+	DeletionWorkers                      int
+	SetBasedPostPurge                    bool
+	PostPurgeBatchSize                   int
+	PostPurgeRowLimit                    int
 }
 
 // Clone shallow copies the configuration. Your implementation may require a deep copy if
@@ -39,6 +75,21 @@ func (c *configuration) TargetEmailAddresses() []string {
 	return parseCSVLine(c.TargetEmailAddressesCSV)
 }
 
+// deletionWorkers returns how many users are deleted at the same time.
+func (c *configuration) deletionWorkers() int {
+	if c.DeletionWorkers < 1 {
+		return 1
+	}
+	if c.DeletionWorkers > maxDeletionWorkers {
+		return maxDeletionWorkers
+	}
+	return c.DeletionWorkers
+}
+
+func (c *configuration) DisabledCleanupStages() []string {
+	return parseCSVLine(c.DisabledCleanupStagesCSV)
+}
+
 func parseCSVLine(line string) []string {
 	var elems []string
 	for _, elem := range strings.Split(line, ",") {
@@ -104,3 +155,72 @@ func (p *Plugin) OnConfigurationChange() error {
 
 	return nil
 }
+
+// ConfigurationWillBeSaved rejects custom cleanup rules that don't match the
+// live database schema, boards placeholder and playbooks fallback users that
+// don't exist, and user export public keys, filter expressions and notice
+// templates that can't be parsed.
+func (p *Plugin) ConfigurationWillBeSaved(newCfg *model.Config) (*model.Config, error) {
+	pluginSettings, ok := newCfg.PluginSettings.Plugins[PluginID]
+	if !ok {
+		return nil, nil
+	}
+
+	// Plugin setting keys are stored lowercased in the server configuration.
+	if publicKey, _ := pluginSettings["userexportpublickey"].(string); publicKey != "" {
+		if _, err := parseExportPublicKey(publicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if expression, _ := pluginSettings["filterexpression"].(string); strings.TrimSpace(expression) != "" {
+		if _, err := parseFilter(expression); err != nil {
+			return nil, fmt.Errorf("%s", describeFilterError(expression, 0, err))
+		}
+	}
+
+	noticeTemplateText, _ := pluginSettings["noticetemplate"].(string)
+	noticeTemplate, err := parseNoticeTemplate(noticeTemplateText)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = renderNotice(noticeTemplate, noticeData{}); err != nil {
+		return nil, err
+	}
+
+	placeholderUsername, _ := pluginSettings["boardsplaceholderusername"].(string)
+	for _, key := range []string{"boardsauthoraction", "boardscommentaction", "boardspersonpropertyaction"} {
+		if action, _ := pluginSettings[key].(string); action == BoardsActionPlaceholder && placeholderUsername == "" {
+			return nil, fmt.Errorf("a boards placeholder user must be configured")
+		}
+	}
+	if placeholderUsername != "" {
+		if _, err = p.pluginClient.User.GetByUsername(placeholderUsername); err != nil {
+			return nil, fmt.Errorf("unable to find boards placeholder user %s: %s", placeholderUsername, err.Error())
+		}
+	}
+	if fallbackUsername, _ := pluginSettings["playbooksfallbackusername"].(string); fallbackUsername != "" {
+		if _, err = p.pluginClient.User.GetByUsername(fallbackUsername); err != nil {
+			return nil, fmt.Errorf("unable to find playbooks fallback user %s: %s", fallbackUsername, err.Error())
+		}
+	}
+
+	document, _ := pluginSettings["customcleanuprules"].(string)
+	rules, err := parseCleanupRules(document)
+	if err != nil {
+		return nil, fmt.Errorf("invalid custom cleanup rules: %s", err.Error())
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	db, err := getDatabase(p.pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to validate custom cleanup rules: %s", err.Error())
+	}
+	if err := validateCleanupRulesSchema(db, rules); err != nil {
+		return nil, fmt.Errorf("invalid custom cleanup rules: %s", err.Error())
+	}
+
+	return nil, nil
+}
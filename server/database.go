@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+
+	_ "github.com/lib/pq"
+)
+
+// database pairs the server's database handle with the driver it uses, so
+// that queries can account for the differences between PostgreSQL and MySQL.
+type database struct {
+	*sql.DB
+	driverName string
+}
+
+func getDatabase(pluginClient *pluginapi.Client) (*database, error) {
+	driverName := model.DatabaseDriverPostgres
+	if sqlSettings := pluginClient.Configuration.GetConfig().SqlSettings; sqlSettings.DriverName != nil {
+		driverName = *sqlSettings.DriverName
+	}
+	if driverName != model.DatabaseDriverPostgres && driverName != model.DatabaseDriverMysql {
+		return nil, fmt.Errorf("unsupported database driver: %s", driverName)
+	}
+
+	db, err := pluginClient.Store.GetMasterDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return &database{DB: db, driverName: driverName}, nil
+}
+
+func (db *database) isMySQL() bool {
+	return db.driverName == model.DatabaseDriverMysql
+}
+
+// placeholder returns the bind parameter format of the driver.
+func (db *database) placeholder() sq.PlaceholderFormat {
+	if db.isMySQL() {
+		return sq.Question
+	}
+	return sq.Dollar
+}
+
+// currentSchema returns an expression for the schema holding the Mattermost
+// tables.
+func (db *database) currentSchema() string {
+	if db.isMySQL() {
+		return "DATABASE()"
+	}
+	return "current_schema()"
+}
+
+// jsonText returns an expression extracting the given top level key of a JSON
+// column as text.
+func (db *database) jsonText(column, key string) string {
+	if db.isMySQL() {
+		return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(%s, '$.%s'))", column, key)
+	}
+	return fmt.Sprintf("%s->>'%s'", column, key)
+}
+
+// quoteIdentifier quotes a table or column name discovered at runtime.
+func (db *database) quoteIdentifier(name string) string {
+	if db.isMySQL() {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// queryIDs runs a query selecting a single ID column and returns the IDs.
+func queryIDs(db *database, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// getExistingUserIDs returns the set of the given user IDs that still exist.
+func getExistingUserIDs(db *database, userIDs []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+		end := start + userIDLookupBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		query := sq.Select("Id").
+			From("Users").
+			Where(sq.Eq{"Id": userIDs[start:end]}).
+			PlaceholderFormat(db.placeholder())
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to build the users query: %s", err.Error())
+		}
+
+		ids, err := queryIDs(db, queryString, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to find existing users: %s", err.Error())
+		}
+		for _, id := range ids {
+			existing[id] = true
+		}
+	}
+	return existing, nil
+}
+
+// membership describes a table linking containers, such as boards or
+// playbook runs, to their member users.
+type membership struct {
+	Table           string
+	ContainerColumn string
+	UserColumn      string
+	// PermanentMembers are members that remain even though they aren't
+	// users, such as the boards system user.
+	PermanentMembers []string
+	// Condition, if set, selects the rows of Table that are memberships.
+	Condition sq.Sqlizer
+}
+
+// findContainersLeftByUsers returns the containers the given users are
+// members of that have no other members left, mapped to how many of their
+// members still exist, all of which are among the given users. Members
+// that aren't users, like an empty owner, are ignored. Queries are run in
+// batches, so any number of users fits in the database's parameter limits.
+func findContainersLeftByUsers(db *database, memberships []membership, userIDs []string) (map[string]int, error) {
+	targeted := map[string]bool{}
+	for _, id := range userIDs {
+		targeted[id] = true
+	}
+
+	candidates := map[string]bool{}
+	for _, m := range memberships {
+		for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+			end := start + userIDLookupBatchSize
+			if end > len(userIDs) {
+				end = len(userIDs)
+			}
+
+			queryString, args, err := sq.Select(m.ContainerColumn).
+				Distinct().
+				From(m.Table).
+				Where(sq.Eq{m.UserColumn: userIDs[start:end]}).
+				Where(m.Condition).
+				PlaceholderFormat(db.placeholder()).
+				ToSql()
+			if err != nil {
+				return nil, fmt.Errorf("error when trying to build the %s query: %s", m.Table, err.Error())
+			}
+
+			ids, err := queryIDs(db, queryString, args...)
+			if err != nil {
+				return nil, fmt.Errorf("error when trying to find %s of users: %s", m.Table, err.Error())
+			}
+			for _, id := range ids {
+				candidates[id] = true
+			}
+		}
+	}
+
+	containerIDs := make([]string, 0, len(candidates))
+	for id := range candidates {
+		containerIDs = append(containerIDs, id)
+	}
+
+	left := map[string]int{}
+	for start := 0; start < len(containerIDs); start += userIDLookupBatchSize {
+		end := start + userIDLookupBatchSize
+		if end > len(containerIDs) {
+			end = len(containerIDs)
+		}
+		batch := containerIDs[start:end]
+
+		members := map[string][]string{}
+		var memberIDs []string
+		permanent := map[string]bool{}
+		for _, m := range memberships {
+			for _, id := range m.PermanentMembers {
+				permanent[id] = true
+			}
+
+			queryString, args, err := sq.Select(m.ContainerColumn, m.UserColumn).
+				From(m.Table).
+				Where(sq.Eq{m.ContainerColumn: batch}).
+				Where(m.Condition).
+				PlaceholderFormat(db.placeholder()).
+				ToSql()
+			if err != nil {
+				return nil, fmt.Errorf("error when trying to build the %s members query: %s", m.Table, err.Error())
+			}
+
+			pairs, err := queryIDPairs(db, queryString, args...)
+			if err != nil {
+				return nil, fmt.Errorf("error when trying to list %s members: %s", m.Table, err.Error())
+			}
+			for _, pair := range pairs {
+				members[pair[0]] = append(members[pair[0]], pair[1])
+				memberIDs = append(memberIDs, pair[1])
+			}
+		}
+
+		existing, err := getExistingUserIDs(db, memberIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, containerID := range batch {
+			remaining := false
+			count := 0
+			counted := map[string]bool{}
+			for _, userID := range members[containerID] {
+				switch {
+				case permanent[userID]:
+					remaining = true
+				case !existing[userID]:
+					// Members already deleted don't count.
+				case !targeted[userID]:
+					remaining = true
+				case !counted[userID]:
+					counted[userID] = true
+					count++
+				}
+			}
+			if !remaining {
+				left[containerID] = count
+			}
+		}
+	}
+	return left, nil
+}
+
+// queryIDPairs runs a query selecting two ID columns and returns the pairs.
+func queryIDPairs(db *database, query string, args ...interface{}) ([][2]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs [][2]string
+	for rows.Next() {
+		var pair [2]string
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, rows.Err()
+}
@@ -5,106 +5,235 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	sq "github.com/Masterminds/squirrel"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
-
-	_ "github.com/lib/pq"
 )
 
-func purgeUsers(db *sql.DB, pluginClient *pluginapi.Client, socketClient *model.Client4, users []*model.User, reportProgress func(int)) (int, error) {
-	for i, user := range users {
-		resp, err := socketClient.PermanentDeleteUser(context.Background(), user.Id)
-		if err != nil {
-			return i, err
+// userBatchSize is the number of users deleted between plugin hook calls.
+const userBatchSize = 100
+
+// maxDeletionWorkers caps the number of users deleted at the same time.
+const maxDeletionWorkers = 16
+
+// purgeUsers deletes the users with up to workers users at a time, and
+// reports the number of users deleted so far after each one. It returns the
+// number of users deleted and the first error. If purgePosts is true, the
+// posts left behind by every user whose account is gone are then purged one
+// user at a time, including users whose later cleanup steps failed. Replies
+// by other users are deleted along with them, so concurrent purges would
+// contend for the same threads.
+func purgeUsers(db *database, tables map[string]string, rules []cleanupRule, pluginClient *pluginapi.Client, socketClient *model.Client4, users []*model.User, workers int, purgePosts bool, reportProgress func(int)) (int, error) {
+	count, err := runWorkerPool(len(users), workers, func(i int) error {
+		return purgeUser(db, tables, rules, pluginClient, socketClient, users[i])
+	}, reportProgress)
+	if !purgePosts {
+		return count, err
+	}
+
+	userIDs := make([]string, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.Id)
+	}
+	existing, existingErr := getExistingUserIDs(db, userIDs)
+	if existingErr != nil {
+		existingErr = fmt.Errorf("error trying to find deleted users: %s", existingErr.Error())
+		if err == nil {
+			return count, existingErr
 		}
-		if resp.StatusCode != http.StatusOK {
-			return i, fmt.Errorf("%d status code during attempt to delete user %s", resp.StatusCode, user.Email)
+		pluginClient.Log.Error("Error purging dangling posts", "error", existingErr)
+		return count, err
+	}
+
+	for _, user := range users {
+		if existing[user.Id] {
+			continue
 		}
 		// There's a bug in `PermanentDeleteUser` that could result in
 		// some user posts not getting deleted. So we go in after to
 		// make sure all posts tied to this user are removed.
-		if err := purgeDanglingUserPosts(db, user.Id); err != nil {
-			return i, fmt.Errorf("error trying to purge dangling posts for user %s: %s", user.Id, err.Error())
-		}
-		// `PermanentDeleteUser` misses a few tables with user data.
-		// We take an extra step here to ensure that data is removed.
-		if err := purgeDanglingUserData(db, user.Id); err != nil {
-			return i, fmt.Errorf("error trying to purge dangling metadata for user %s: %s", user.Id, err.Error())
+		if postsErr := purgeDanglingUserPosts(db, user.Id); postsErr != nil {
+			postsErr = fmt.Errorf("error trying to purge dangling posts for user %s: %s", user.Id, postsErr.Error())
+			if err == nil {
+				return count, postsErr
+			}
+			pluginClient.Log.Error("Error purging dangling posts", "error", postsErr)
+			break
 		}
-		pluginClient.Log.Info("Deleted user", "user", user.Email)
-		reportProgress(i + 1)
 	}
-	return len(users), nil
+	return count, err
 }
 
-func purgeDanglingUserData(db *sql.DB, userID string) (err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
-	}
-	defer func() {
-		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
-			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
-				rollbackErr.Error(), err.Error())
+// purgeUser deletes a user and the data PermanentDeleteUser leaves behind,
+// except for their posts.
+func purgeUser(db *database, tables map[string]string, rules []cleanupRule, pluginClient *pluginapi.Client, socketClient *model.Client4, user *model.User) error {
+	if user.IsBot {
+		if err := purgeBot(db, pluginClient, user.Id); err != nil {
+			return fmt.Errorf("error trying to delete bot %s: %s", user.Id, err.Error())
 		}
-	}()
-
-	deleteStatusQuery := sq.Delete("Status").
-		Where(sq.Eq{"userid": userID}).
-		PlaceholderFormat(sq.Dollar)
+	} else {
+		resp, err := socketClient.PermanentDeleteUser(context.Background(), user.Id)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%d status code during attempt to delete user %s", resp.StatusCode, user.Email)
+		}
+	}
+	// `PermanentDeleteUser` misses a few tables with user data.
+	// We take an extra step here to ensure that data is removed.
+	if err := purgeDanglingUserData(db, tables, user.Id); err != nil {
+		return fmt.Errorf("error trying to purge dangling metadata for user %s: %s", user.Id, err.Error())
+	}
+	// Custom cleanup rules cover tables created by other plugins
+	// and integrations.
+	if err := purgeCustomRuleData(db, rules, user.Id); err != nil {
+		return fmt.Errorf("error trying to apply custom cleanup rules for user %s: %s", user.Id, err.Error())
+	}
+	pluginClient.Log.Info("Deleted user", "user", user.Email)
+	return nil
+}
 
-	deleteStatusQueryString, deleteStatusArgs, err := deleteStatusQuery.ToSql()
-	if err != nil {
-		return fmt.Errorf("error when trying to build the delete status query: %s", err.Error())
+// runWorkerPool calls work for each index below count, with up to workers
+// calls running at a time, and calls done with the number of successful
+// calls as they succeed. Once a call fails no new calls start, but the calls
+// already running finish, so no user is left halfway through its cleanup
+// steps. It returns the number of successful calls and the first error.
+//
+// done is called from a single goroutine, outside the pool's lock, so a slow
+// call doesn't hold up the workers. Counts that succeed each other while it
+// runs are reported together, but the final count is always reported.
+func runWorkerPool(count int, workers int, work func(i int) error, done func(completed int)) (int, error) {
+	if workers < 1 {
+		workers = 1
 	}
 
-	_, err = tx.Exec(deleteStatusQueryString, deleteStatusArgs...)
-	if err != nil {
-		return fmt.Errorf("error when trying to delete user status: %s", err.Error())
+	var lock sync.Mutex
+	var completed int
+	var firstErr error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
 	}
 
-	deleteChannelMemberHistoryQuery := sq.Delete("ChannelMemberHistory").
-		Where(sq.Eq{"userid": userID}).
-		PlaceholderFormat(sq.Dollar)
+	progress := make(chan struct{}, 1)
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		reported := 0
+		for range progress {
+			lock.Lock()
+			current := completed
+			lock.Unlock()
+			if current > reported {
+				reported = current
+				done(current)
+			}
+		}
+	}()
 
-	deleteChannelMemberHistoryQueryString, deleteChannelMemberHistoryArgs, err := deleteChannelMemberHistoryQuery.ToSql()
-	if err != nil {
-		return fmt.Errorf("error when trying to build the delete channel member history query: %s", err.Error())
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if failed() {
+					continue
+				}
+				err := work(i)
+
+				lock.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+				} else {
+					completed++
+				}
+				lock.Unlock()
+
+				if err == nil {
+					select {
+					case progress <- struct{}{}:
+					default:
+						// A report is already pending and will include
+						// this call.
+					}
+				}
+			}
+		}()
 	}
 
-	_, err = tx.Exec(deleteChannelMemberHistoryQueryString, deleteChannelMemberHistoryArgs...)
-	if err != nil {
-		return fmt.Errorf("error when trying to delete user channel member history: %s", err.Error())
+	for i := 0; i < count && !failed(); i++ {
+		indexes <- i
 	}
+	close(indexes)
+	wg.Wait()
+	close(progress)
+	<-progressDone
 
-	deleteSidebarCategoriesQuery := sq.Delete("SidebarCategories").
-		Where(sq.Eq{"userid": userID}).
-		PlaceholderFormat(sq.Dollar)
+	return completed, firstErr
+}
 
-	deleteSidebarCategoriesQueryString, deleteSidebarCategoriesArgs, err := deleteSidebarCategoriesQuery.ToSql()
-	if err != nil {
-		return fmt.Errorf("error when trying to build the delete sidebar categories query: %s", err.Error())
-	}
+// danglingUserDataTables lists tables with per-user rows that
+// `PermanentDeleteUser` leaves behind. Tables are deleted from in order, and
+// any table missing from the server's schema version is skipped.
+var danglingUserDataTables = []struct {
+	table       string
+	column      string
+	description string
+}{
+	{"Status", "userid", "status"},
+	{"ChannelMemberHistory", "userid", "channel member history"},
+	{"SidebarChannels", "userid", "sidebar channels"},
+	{"SidebarCategories", "userid", "sidebar categories"},
+	{"ProductNoticeViewState", "userid", "product notice view state"},
+	{"Preferences", "userid", "preferences"},
+	{"Drafts", "userid", "drafts"},
+	{"ScheduledPosts", "userid", "scheduled posts"},
+	{"UserTermsOfService", "userid", "terms of service acceptance"},
+	{"PostAcknowledgements", "userid", "post acknowledgements"},
+	{"PostReminders", "userid", "post reminders"},
+	{"Audits", "userid", "audits"},
+	{"NotifyAdmin", "userid", "admin notifications"},
+}
 
-	_, err = tx.Exec(deleteSidebarCategoriesQueryString, deleteSidebarCategoriesArgs...)
+func purgeDanglingUserData(db *database, tables map[string]string, userID string) (err error) {
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("error when trying to delete user sidebar categories: %s", err.Error())
+		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
 	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
+				rollbackErr.Error(), err.Error())
+		}
+	}()
 
-	deleteProductNoticeViewStateQuery := sq.Delete("ProductNoticeViewState").
-		Where(sq.Eq{"userid": userID}).
-		PlaceholderFormat(sq.Dollar)
+	for _, data := range danglingUserDataTables {
+		if _, ok := tables[strings.ToLower(data.table)]; !ok {
+			continue
+		}
 
-	deleteProductNoticeViewStateQueryString, deleteProductNoticeViewStateArgs, err := deleteProductNoticeViewStateQuery.ToSql()
-	if err != nil {
-		return fmt.Errorf("error when trying to build the delete product notice view state query: %s", err.Error())
-	}
+		deleteQuery := sq.Delete(data.table).
+			Where(sq.Eq{data.column: userID}).
+			PlaceholderFormat(db.placeholder())
 
-	_, err = tx.Exec(deleteProductNoticeViewStateQueryString, deleteProductNoticeViewStateArgs...)
-	if err != nil {
-		return fmt.Errorf("error when trying to delete user product notice view state: %s", err.Error())
+		deleteQueryString, deleteArgs, err := deleteQuery.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the delete %s query: %s", data.description, err.Error())
+		}
+
+		_, err = tx.Exec(deleteQueryString, deleteArgs...)
+		if err != nil {
+			return fmt.Errorf("error when trying to delete user %s: %s", data.description, err.Error())
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -114,7 +243,29 @@ func purgeDanglingUserData(db *sql.DB, userID string) (err error) {
 	return nil
 }
 
-func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
+// purgeOrphanedPersistentNotifications removes persistent notifications whose
+// posts were deleted. They are keyed by post rather than by user, and finding
+// them scans the whole table, so this runs once per batch of deleted users
+// rather than once per user.
+func purgeOrphanedPersistentNotifications(db *database, tables map[string]string) error {
+	if _, ok := tables["persistentnotifications"]; !ok {
+		return nil
+	}
+	_, err := db.Exec(`
+		DELETE FROM PersistentNotifications
+		  WHERE NOT EXISTS (
+		    SELECT 1
+		    FROM Posts
+		      WHERE Posts.id = PersistentNotifications.postid
+		  );
+	`)
+	if err != nil {
+		return fmt.Errorf("error when trying to delete orphaned persistent notifications: %s", err.Error())
+	}
+	return nil
+}
+
+func purgeDanglingUserPosts(db *database, userID string) (err error) {
 	for {
 		tx, err := db.Begin()
 		if err != nil {
@@ -131,7 +282,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 			From("Posts").
 			Where(sq.Eq{"UserId": userID}).
 			Limit(1000).
-			PlaceholderFormat(sq.Dollar)
+			PlaceholderFormat(db.placeholder())
 
 		queryString, args, err := query.ToSql()
 		if err != nil {
@@ -159,7 +310,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 
 		deleteThreadsQuery := sq.Delete("Threads").
 			Where(sq.Eq{"postid": ids}).
-			PlaceholderFormat(sq.Dollar)
+			PlaceholderFormat(db.placeholder())
 
 		deleteThreadsQueryString, deleteThreadsArgs, err := deleteThreadsQuery.ToSql()
 		if err != nil {
@@ -173,7 +324,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 
 		deleteThreadMembershipsQuery := sq.Delete("ThreadMemberships").
 			Where(sq.Eq{"postid": ids}).
-			PlaceholderFormat(sq.Dollar)
+			PlaceholderFormat(db.placeholder())
 
 		deleteThreadMembershipsQueryString, deleteThreadMembershipsArgs, err := deleteThreadMembershipsQuery.ToSql()
 		if err != nil {
@@ -187,7 +338,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 
 		deleteReactionsQueryString, deleteReactionsArgs, err := sq.Delete("Reactions").
 			Where(sq.Eq{"postid": ids}).
-			PlaceholderFormat(sq.Dollar).
+			PlaceholderFormat(db.placeholder()).
 			ToSql()
 		if err != nil {
 			return fmt.Errorf("error when trying to select user posts: %s", err.Error())
@@ -201,7 +352,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 		// Delete comments under posts
 		deletePostsQuery := sq.Delete("Posts").
 			Where(sq.Eq{"rootid": ids}).
-			PlaceholderFormat(sq.Dollar)
+			PlaceholderFormat(db.placeholder())
 
 		deletePostsQueryString, deletePostsArgs, err := deletePostsQuery.ToSql()
 		if err != nil {
@@ -215,7 +366,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 
 		deletePostsQuery = sq.Delete("Posts").
 			Where(sq.Eq{"Id": ids}).
-			PlaceholderFormat(sq.Dollar)
+			PlaceholderFormat(db.placeholder())
 
 		deletePostsQueryString, deletePostsArgs, err = deletePostsQuery.ToSql()
 		if err != nil {
@@ -235,7 +386,7 @@ func purgeDanglingUserPosts(db *sql.DB, userID string) (err error) {
 	return nil
 }
 
-func purgeEmptyChannels(db *sql.DB, pluginClient *pluginapi.Client, socketClient *model.Client4) error {
+func purgeEmptyChannels(db *database, pluginClient *pluginapi.Client, socketClient *model.Client4) error {
 	for {
 		rows, err := db.Query(`
 			SELECT id FROM Channels
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_runWorkerPool(t *testing.T) {
+	t.Run("all work should complete with progress in order", func(t *testing.T) {
+		var progress []int
+		completed, err := runWorkerPool(50, 4, func(i int) error {
+			return nil
+		}, func(completed int) {
+			progress = append(progress, completed)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if completed != 50 {
+			t.Errorf("expected: '%d', got: '%d'", 50, completed)
+		}
+		for i := 1; i < len(progress); i++ {
+			if progress[i] <= progress[i-1] {
+				t.Fatalf("expected progress to increase, got: '%v'", progress)
+			}
+		}
+		if len(progress) == 0 || progress[len(progress)-1] != 50 {
+			t.Errorf("expected final progress: '%d', got: '%v'", 50, progress)
+		}
+	})
+
+	t.Run("slow progress reports should not block workers", func(t *testing.T) {
+		var lock sync.Mutex
+		var reports int
+		start := time.Now()
+		completed, err := runWorkerPool(20, 4, func(i int) error {
+			return nil
+		}, func(int) {
+			lock.Lock()
+			reports++
+			lock.Unlock()
+			time.Sleep(20 * time.Millisecond)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if completed != 20 {
+			t.Errorf("expected: '%d', got: '%d'", 20, completed)
+		}
+		if elapsed := time.Since(start); elapsed >= 20*20*time.Millisecond {
+			t.Errorf("expected coalesced reports, took: '%s' for %d reports", elapsed, reports)
+		}
+	})
+
+	t.Run("workers should be bounded", func(t *testing.T) {
+		var lock sync.Mutex
+		var running, maxRunning int
+		_, err := runWorkerPool(20, 3, func(i int) error {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return nil
+		}, func(int) {})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if maxRunning > 3 {
+			t.Errorf("expected at most 3 workers, got: '%d'", maxRunning)
+		}
+	})
+
+	t.Run("failure should stop new work and finish started work", func(t *testing.T) {
+		var lock sync.Mutex
+		started := map[int]bool{}
+		finished := map[int]bool{}
+		failure := errors.New("failed")
+		completed, err := runWorkerPool(100, 4, func(i int) error {
+			lock.Lock()
+			started[i] = true
+			lock.Unlock()
+
+			if i == 5 {
+				return failure
+			}
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			finished[i] = true
+			lock.Unlock()
+			return nil
+		}, func(int) {})
+		if err != failure {
+			t.Fatalf("expected: '%v', got: '%v'", failure, err)
+		}
+		if len(started) >= 100 {
+			t.Errorf("expected new work to stop, but all work started")
+		}
+		if len(finished) != len(started)-1 {
+			t.Errorf("expected: '%d', got: '%d'", len(started)-1, len(finished))
+		}
+		if completed != len(finished) {
+			t.Errorf("expected: '%d', got: '%d'", len(finished), completed)
+		}
+	})
+
+	t.Run("single worker should stop at the failing index", func(t *testing.T) {
+		completed, err := runWorkerPool(10, 1, func(i int) error {
+			if i == 3 {
+				return errors.New("failed")
+			}
+			return nil
+		}, func(int) {})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if completed != 3 {
+			t.Errorf("expected: '%d', got: '%d'", 3, completed)
+		}
+	})
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// A filter expression selects users by combining conditions on their fields
+// and memberships with AND, OR, NOT and parentheses, for example:
+//
+//	auth=saml AND last_active<180d AND email~"@old\.example\.com$" AND NOT team:core
+//
+// Times are compared as points in time, so a duration like 180d stands for
+// 180 days ago and last_active<180d matches users last active before then.
+
+const filterMembershipTeam = "team"
+const filterMembershipChannel = "channel"
+
+var filterDurationPattern = regexp.MustCompile(`^([0-9]+)([hdw])$`)
+
+// filterError is a filter parse error at a byte position of the expression.
+type filterError struct {
+	Pos     int
+	Message string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos+1)
+}
+
+// describeFilterError formats a filter parse error with a marker under the
+// position it points at. offset is where the expression starts in text.
+func describeFilterError(text string, offset int, err error) string {
+	parseErr, ok := err.(*filterError)
+	if !ok {
+		return fmt.Sprintf("invalid filter: %s", err.Error())
+	}
+	pos := offset + parseErr.Pos
+	if pos > len(text) {
+		pos = len(text)
+	}
+	column := utf8.RuneCountInString(text[:pos])
+	return fmt.Sprintf("invalid filter: %s at position %d:\n```\n%s\n%s^\n```",
+		parseErr.Message, column+1, text, strings.Repeat(" ", column))
+}
+
+// filterLookups holds the data a filter needs beyond the user record.
+type filterLookups struct {
+	now            time.Time
+	lastActivity   map[string]int64
+	teamMembers    map[string]map[string]bool
+	channelMembers map[string]map[string]bool
+}
+
+// filterNode is a parsed filter expression.
+type filterNode interface {
+	matches(user *model.User, lookups *filterLookups) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ operand filterNode }
+
+func (n *filterAnd) matches(user *model.User, lookups *filterLookups) bool {
+	return n.left.matches(user, lookups) && n.right.matches(user, lookups)
+}
+
+func (n *filterOr) matches(user *model.User, lookups *filterLookups) bool {
+	return n.left.matches(user, lookups) || n.right.matches(user, lookups)
+}
+
+func (n *filterNot) matches(user *model.User, lookups *filterLookups) bool {
+	return !n.operand.matches(user, lookups)
+}
+
+// filterMembership matches members of a team, or of a channel in any team,
+// by name.
+type filterMembership struct {
+	kind string
+	name string
+}
+
+func (n *filterMembership) matches(user *model.User, lookups *filterLookups) bool {
+	if n.kind == filterMembershipTeam {
+		return lookups.teamMembers[n.name][user.Id]
+	}
+	return lookups.channelMembers[n.name][user.Id]
+}
+
+// filterStringFields returns the values of each text field. A user matches
+// a condition on a field with several values, like role, if any value does.
+var filterStringFields = map[string]func(user *model.User) []string{
+	"email":      func(user *model.User) []string { return []string{user.Email} },
+	"username":   func(user *model.User) []string { return []string{user.Username} },
+	"first_name": func(user *model.User) []string { return []string{user.FirstName} },
+	"last_name":  func(user *model.User) []string { return []string{user.LastName} },
+	"nickname":   func(user *model.User) []string { return []string{user.Nickname} },
+	"position":   func(user *model.User) []string { return []string{user.Position} },
+	"locale":     func(user *model.User) []string { return []string{user.Locale} },
+	"auth": func(user *model.User) []string {
+		if user.AuthService == "" {
+			return []string{model.UserAuthServiceEmail}
+		}
+		return []string{user.AuthService}
+	},
+	"role": func(user *model.User) []string { return user.GetRoles() },
+}
+
+// filterTimeFields returns the time of each time field, and false if the
+// user has no such time.
+var filterTimeFields = map[string]func(user *model.User, lookups *filterLookups) (int64, bool){
+	"created": func(user *model.User, _ *filterLookups) (int64, bool) { return user.CreateAt, true },
+	"last_active": func(user *model.User, lookups *filterLookups) (int64, bool) {
+		return lookups.lastActivity[user.Id], true
+	},
+	"deactivated": func(user *model.User, _ *filterLookups) (int64, bool) { return user.DeleteAt, user.DeleteAt != 0 },
+}
+
+var filterBoolFields = map[string]func(user *model.User) bool{
+	"active": func(user *model.User) bool { return user.DeleteAt == 0 },
+}
+
+type filterStringCondition struct {
+	field   string
+	op      string
+	value   string
+	pattern *regexp.Regexp
+}
+
+func (n *filterStringCondition) matches(user *model.User, _ *filterLookups) bool {
+	var found bool
+	for _, value := range filterStringFields[n.field](user) {
+		if n.pattern != nil {
+			found = n.pattern.MatchString(value)
+		} else {
+			found = strings.EqualFold(value, n.value)
+		}
+		if found {
+			break
+		}
+	}
+	if n.op == "!=" || n.op == "!~" {
+		return !found
+	}
+	return found
+}
+
+// filterTimeCondition compares a time field with either a time ago or a
+// date.
+type filterTimeCondition struct {
+	field string
+	op    string
+	ago   time.Duration
+	date  time.Time
+}
+
+func (n *filterTimeCondition) matches(user *model.User, lookups *filterLookups) bool {
+	value, ok := filterTimeFields[n.field](user, lookups)
+	if !ok {
+		return false
+	}
+	at := n.date
+	if at.IsZero() {
+		at = lookups.now.Add(-n.ago)
+	}
+	target := model.GetMillisForTime(at)
+
+	switch n.op {
+	case "<":
+		return value < target
+	case "<=":
+		return value <= target
+	case ">":
+		return value > target
+	default:
+		return value >= target
+	}
+}
+
+type filterBoolCondition struct {
+	field string
+	value bool
+}
+
+func (n *filterBoolCondition) matches(user *model.User, _ *filterLookups) bool {
+	return filterBoolFields[n.field](user) == n.value
+}
+
+// walkFilter calls visit for each node of the filter.
+func walkFilter(node filterNode, visit func(filterNode)) {
+	visit(node)
+	switch n := node.(type) {
+	case *filterAnd:
+		walkFilter(n.left, visit)
+		walkFilter(n.right, visit)
+	case *filterOr:
+		walkFilter(n.left, visit)
+		walkFilter(n.right, visit)
+	case *filterNot:
+		walkFilter(n.operand, visit)
+	}
+}
+
+const (
+	filterTokenWord = iota
+	filterTokenString
+	filterTokenOperator
+	filterTokenColon
+	filterTokenLeftParen
+	filterTokenRightParen
+	filterTokenEnd
+)
+
+type filterToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// describe names the token for error messages.
+func (t filterToken) describe() string {
+	if t.kind == filterTokenEnd {
+		return "end of filter"
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+var filterOperators = []string{"!=", "!~", "<=", ">=", "=", "~", "<", ">"}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	var tokens []filterToken
+	pos := 0
+	for pos < len(expression) {
+		r, size := utf8.DecodeRuneInString(expression[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case r == '(':
+			tokens = append(tokens, filterToken{filterTokenLeftParen, "(", pos})
+			pos++
+		case r == ')':
+			tokens = append(tokens, filterToken{filterTokenRightParen, ")", pos})
+			pos++
+		case r == ':':
+			tokens = append(tokens, filterToken{filterTokenColon, ":", pos})
+			pos++
+		case r == '"':
+			text, end, err := scanFilterString(expression, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{filterTokenString, text, pos})
+			pos = end
+		case strings.ContainsRune("!=~<>", r):
+			var operator string
+			for _, candidate := range filterOperators {
+				if strings.HasPrefix(expression[pos:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, &filterError{pos, fmt.Sprintf("unknown operator '%c'", r)}
+			}
+			tokens = append(tokens, filterToken{filterTokenOperator, operator, pos})
+			pos += len(operator)
+		default:
+			end := pos
+			for end < len(expression) {
+				r, size := utf8.DecodeRuneInString(expression[end:])
+				if unicode.IsSpace(r) || strings.ContainsRune(`()":!=~<>`, r) {
+					break
+				}
+				end += size
+			}
+			tokens = append(tokens, filterToken{filterTokenWord, expression[pos:end], pos})
+			pos = end
+		}
+	}
+	return append(tokens, filterToken{filterTokenEnd, "", len(expression)}), nil
+}
+
+// scanFilterString reads the quoted string starting at start, and returns
+// its text and the position after it. Only \" and \\ are escapes, so other
+// backslashes are kept for regular expressions.
+func scanFilterString(expression string, start int) (string, int, error) {
+	var text strings.Builder
+	for pos := start + 1; pos < len(expression); pos++ {
+		switch expression[pos] {
+		case '"':
+			return text.String(), pos + 1, nil
+		case '\\':
+			if pos+1 < len(expression) && (expression[pos+1] == '"' || expression[pos+1] == '\\') {
+				pos++
+			}
+		}
+		text.WriteByte(expression[pos])
+	}
+	return "", 0, &filterError{start, "unterminated string"}
+}
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+// parseFilter parses a filter expression.
+func parseFilter(expression string) (filterNode, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if tokens[0].kind == filterTokenEnd {
+		return nil, &filterError{0, "empty filter"}
+	}
+
+	parser := &filterParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != filterTokenEnd {
+		return nil, &filterError{token.pos, fmt.Sprintf("unexpected %s", token.describe())}
+	}
+	return node, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	token := p.tokens[p.next]
+	if token.kind != filterTokenEnd {
+		p.next++
+	}
+	return token
+}
+
+func (p *filterParser) takeKeyword(keyword string) bool {
+	token := p.peek()
+	if token.kind == filterTokenWord && strings.EqualFold(token.text, keyword) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.takeKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.takeKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.takeKeyword("NOT") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	token := p.take()
+	if token.kind == filterTokenLeftParen {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != filterTokenRightParen {
+			return nil, &filterError{closing.pos, fmt.Sprintf("expected ')' but found %s", closing.describe())}
+		}
+		return node, nil
+	}
+
+	if token.kind != filterTokenWord || isFilterKeyword(token.text) {
+		return nil, &filterError{token.pos, fmt.Sprintf("expected a condition but found %s", token.describe())}
+	}
+
+	name := strings.ToLower(token.text)
+	operator := p.take()
+	switch operator.kind {
+	case filterTokenColon:
+		return p.parseMembership(token, name)
+	case filterTokenOperator:
+		return p.parseCondition(token, name, operator)
+	}
+	return nil, &filterError{operator.pos, fmt.Sprintf("expected an operator after '%s' but found %s", token.text, operator.describe())}
+}
+
+func (p *filterParser) parseMembership(kindToken filterToken, kind string) (filterNode, error) {
+	if kind != filterMembershipTeam && kind != filterMembershipChannel {
+		return nil, &filterError{kindToken.pos, fmt.Sprintf("unknown membership '%s'. Must be '%s' or '%s'",
+			kindToken.text, filterMembershipTeam, filterMembershipChannel)}
+	}
+	value := p.take()
+	if value.kind != filterTokenWord && value.kind != filterTokenString || value.text == "" {
+		return nil, &filterError{value.pos, fmt.Sprintf("expected a %s name but found %s", kind, value.describe())}
+	}
+	return &filterMembership{kind: kind, name: value.text}, nil
+}
+
+func (p *filterParser) parseCondition(fieldToken filterToken, field string, operator filterToken) (filterNode, error) {
+	value := p.take()
+	if value.kind != filterTokenWord && value.kind != filterTokenString {
+		return nil, &filterError{value.pos, fmt.Sprintf("expected a value but found %s", value.describe())}
+	}
+
+	if _, ok := filterStringFields[field]; ok {
+		condition := &filterStringCondition{field: field, op: operator.text, value: value.text}
+		switch operator.text {
+		case "=", "!=":
+		case "~", "!~":
+			pattern, err := regexp.Compile(value.text)
+			if err != nil {
+				return nil, &filterError{value.pos, fmt.Sprintf("invalid regular expression: %s", err.Error())}
+			}
+			condition.pattern = pattern
+		default:
+			return nil, &filterError{operator.pos, fmt.Sprintf("'%s' can't be used with '%s'. Use =, !=, ~ or !~", operator.text, fieldToken.text)}
+		}
+		return condition, nil
+	}
+
+	if _, ok := filterTimeFields[field]; ok {
+		if operator.text != "<" && operator.text != "<=" && operator.text != ">" && operator.text != ">=" {
+			return nil, &filterError{operator.pos, fmt.Sprintf("'%s' can't be used with '%s'. Use <, <=, > or >=", operator.text, fieldToken.text)}
+		}
+		condition := &filterTimeCondition{field: field, op: operator.text}
+		if match := filterDurationPattern.FindStringSubmatch(value.text); match != nil {
+			amount, err := strconv.Atoi(match[1])
+			if err != nil {
+				return nil, &filterError{value.pos, fmt.Sprintf("invalid duration '%s'", value.text)}
+			}
+			unit := map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[match[2]]
+			condition.ago = time.Duration(amount) * unit
+			return condition, nil
+		}
+		date, err := time.Parse("2006-01-02", value.text)
+		if err != nil {
+			return nil, &filterError{value.pos, fmt.Sprintf("invalid time '%s'. Use a duration like 90d or a date like 2024-01-31", value.text)}
+		}
+		condition.date = date
+		return condition, nil
+	}
+
+	if _, ok := filterBoolFields[field]; ok {
+		if operator.text != "=" && operator.text != "!=" {
+			return nil, &filterError{operator.pos, fmt.Sprintf("'%s' can't be used with '%s'. Use = or !=", operator.text, fieldToken.text)}
+		}
+		boolValue, err := strconv.ParseBool(value.text)
+		if err != nil {
+			return nil, &filterError{value.pos, fmt.Sprintf("expected true or false but found '%s'", value.text)}
+		}
+		return &filterBoolCondition{field: field, value: boolValue == (operator.text == "=")}, nil
+	}
+
+	return nil, &filterError{fieldToken.pos, fmt.Sprintf("unknown field '%s'", fieldToken.text)}
+}
+
+// selectFilterMatches returns the users the filter matches. Bots and system
+// administrators are never selected.
+func selectFilterMatches(filter filterNode, users []*model.User, lookups *filterLookups) []*model.User {
+	var matching []*model.User
+	for _, user := range users {
+		if user.IsBot || user.IsInRole(model.SystemAdminRoleId) {
+			continue
+		}
+		if filter.matches(user, lookups) {
+			matching = append(matching, user)
+		}
+	}
+	return matching
+}
+
+// selectFilteredUsers returns the IDs of the users matching a filter
+// expression, or the configured filter expression if none is given.
+func (p *Plugin) selectFilteredUsers(expression string) ([]string, error) {
+	if expression == "" {
+		expression = p.getConfiguration().FilterExpression
+	}
+	if strings.TrimSpace(expression) == "" {
+		return nil, fmt.Errorf("no filter expression was given and no default filter expression is configured")
+	}
+	filter, err := parseFilter(expression)
+	if err != nil {
+		return nil, fmt.Errorf("%s", describeFilterError(expression, 0, err))
+	}
+
+	keep, err := p.newFilterPageFilter(filter, false)
+	if err != nil {
+		return nil, err
+	}
+	return p.selectUserIDs(pushDownFilter(filter), keep)
+}
+
+// pushDownFilter returns a query for conditions that every user the filter
+// matches meets, so the other users are never loaded. The filter is still
+// applied to the users the query returns.
+func pushDownFilter(filter filterNode) userQuery {
+	query := userQuery{}
+	var visit func(node filterNode)
+	visit = func(node filterNode) {
+		switch n := node.(type) {
+		case *filterAnd:
+			visit(n.left)
+			visit(n.right)
+		case *filterBoolCondition:
+			if n.field == "active" && !n.value {
+				query.InactiveOnly = true
+			}
+		case *filterStringCondition:
+			if n.op != "=" {
+				return
+			}
+			// Roles and auth services are stored in lowercase. Users who
+			// sign in with email have no auth service to query.
+			if n.field == "role" {
+				query.Role = strings.ToLower(n.value)
+			}
+			if n.field == "auth" && !strings.EqualFold(n.value, model.UserAuthServiceEmail) {
+				query.AuthService = strings.ToLower(n.value)
+			}
+		}
+	}
+	visit(filter)
+	return query
+}
+
+// newFilterPageFilter returns a page filter keeping the users the filter
+// matches or, with exclude, the users it doesn't match. Memberships are
+// loaded once, and activity for each page.
+func (p *Plugin) newFilterPageFilter(filter filterNode, exclude bool) (userPageFilter, error) {
+	lookups, err := p.loadFilterLookups(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var usesLastActive bool
+	walkFilter(filter, func(node filterNode) {
+		if n, ok := node.(*filterTimeCondition); ok && n.field == "last_active" {
+			usesLastActive = true
+		}
+	})
+
+	return func(users []*model.User) ([]*model.User, error) {
+		if usesLastActive {
+			lastActivity, err := getLastActivity(p.pluginClient, getUserIDs(users))
+			if err != nil {
+				return nil, err
+			}
+			lookups.lastActivity = lastActivity
+		}
+		if exclude {
+			return excludeFilterMatches(filter, users, lookups), nil
+		}
+		return selectFilterMatches(filter, users, lookups), nil
+	}, nil
+}
+
+// loadFilterLookups loads the memberships the filter refers to.
+func (p *Plugin) loadFilterLookups(filter filterNode) (*filterLookups, error) {
+	lookups := &filterLookups{
+		now:            time.Now(),
+		lastActivity:   map[string]int64{},
+		teamMembers:    map[string]map[string]bool{},
+		channelMembers: map[string]map[string]bool{},
+	}
+
+	var memberships []*filterMembership
+	walkFilter(filter, func(node filterNode) {
+		if n, ok := node.(*filterMembership); ok {
+			memberships = append(memberships, n)
+		}
+	})
+	if len(memberships) == 0 {
+		return lookups, nil
+	}
+
+	db, err := getDatabase(p.pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing database: %s", err.Error())
+	}
+	for _, membership := range memberships {
+		members := lookups.teamMembers
+		if membership.kind == filterMembershipChannel {
+			members = lookups.channelMembers
+		}
+		if _, ok := members[membership.name]; ok {
+			continue
+		}
+		userIDs, err := getMembersByName(db, membership.kind, membership.name)
+		if err != nil {
+			return nil, err
+		}
+		members[membership.name] = map[string]bool{}
+		for _, userID := range userIDs {
+			members[membership.name][userID] = true
+		}
+	}
+	return lookups, nil
+}
+
+// getMembersByName returns the members of the team, or of every channel,
+// with the given name. An unknown name is an error, so a misspelled NOT
+// team:... condition can't match everyone.
+func getMembersByName(db *database, kind string, name string) ([]string, error) {
+	containers, memberships, containerColumn := "Teams", "TeamMembers", "TeamId"
+	if kind == filterMembershipChannel {
+		containers, memberships, containerColumn = "Channels", "ChannelMembers", "ChannelId"
+	}
+
+	queryString, args, err := sq.Select("Id").
+		From(containers).
+		Where(sq.Eq{"Name": name, "DeleteAt": 0}).
+		PlaceholderFormat(db.placeholder()).
+		ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the %s query: %s", kind, err.Error())
+	}
+	ids, err := queryIDs(db, queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find %s %s: %s", kind, name, err.Error())
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no %s named '%s' was found", kind, name)
+	}
+
+	query := sq.Select("DISTINCT UserId").
+		From(memberships).
+		Where(sq.Eq{containerColumn: ids})
+	if kind == filterMembershipTeam {
+		query = query.Where(sq.Eq{"DeleteAt": 0})
+	}
+	queryString, args, err = query.PlaceholderFormat(db.placeholder()).ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the %s members query: %s", kind, err.Error())
+	}
+	userIDs, err := queryIDs(db, queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find %s %s members: %s", kind, name, err.Error())
+	}
+	return userIDs, nil
+}
+
+func isFilterKeyword(word string) bool {
+	return strings.EqualFold(word, "AND") || strings.EqualFold(word, "OR") || strings.EqualFold(word, "NOT")
+}
+
+// commandRemainder returns the text of a command after its first n fields,
+// and the position in the command where that text starts.
+func commandRemainder(command string, n int) (string, int) {
+	pos := 0
+	for i := 0; i <= n; i++ {
+		pos = len(command) - len(strings.TrimLeftFunc(command[pos:], unicode.IsSpace))
+		if i == n {
+			break
+		}
+		end := strings.IndexFunc(command[pos:], unicode.IsSpace)
+		if end == -1 {
+			return "", len(command)
+		}
+		pos += end
+	}
+	return strings.TrimRightFunc(command[pos:], unicode.IsSpace), pos
+}
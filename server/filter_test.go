@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_parseFilter(t *testing.T) {
+	tests := []struct {
+		description string
+		expression  string
+		expectErr   bool
+		expectedPos int
+	}{{
+		description: "conditions combined with keywords should parse",
+		expression:  `auth=saml AND last_active<180d AND email~"@old\.example\.com$" AND NOT team:core`,
+	}, {
+		description: "parentheses and lowercase keywords should parse",
+		expression:  `(role=system_guest or channel:"town-square") and created>=2024-01-31 and active=false`,
+	}, {
+		description: "empty filter should fail",
+		expression:  "  ",
+		expectErr:   true,
+		expectedPos: 0,
+	}, {
+		description: "unknown field should fail at the field",
+		expression:  "auth=saml AND color=red",
+		expectErr:   true,
+		expectedPos: 14,
+	}, {
+		description: "missing condition should fail at the end",
+		expression:  "auth=saml AND",
+		expectErr:   true,
+		expectedPos: 13,
+	}, {
+		description: "invalid regular expression should fail at the value",
+		expression:  "email~(",
+		expectErr:   true,
+		expectedPos: 6,
+	}, {
+		description: "time operator on a text field should fail at the operator",
+		expression:  "email<90d",
+		expectErr:   true,
+		expectedPos: 5,
+	}, {
+		description: "invalid time should fail at the value",
+		expression:  "last_active<soon",
+		expectErr:   true,
+		expectedPos: 12,
+	}, {
+		description: "unclosed parenthesis should fail at the end",
+		expression:  "(auth=saml",
+		expectErr:   true,
+		expectedPos: 10,
+	}, {
+		description: "unterminated string should fail at the quote",
+		expression:  `email="a@example.com`,
+		expectErr:   true,
+		expectedPos: 6,
+	}, {
+		description: "unknown membership should fail at the kind",
+		expression:  "NOT group:core",
+		expectErr:   true,
+		expectedPos: 4,
+	}, {
+		description: "trailing token should fail at the token",
+		expression:  "auth=saml auth=ldap",
+		expectErr:   true,
+		expectedPos: 10,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := parseFilter(test.expression)
+			if !test.expectErr {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			parseErr, ok := err.(*filterError)
+			if !ok {
+				t.Fatalf("expected a filter error, got: '%v'", err)
+			}
+			if parseErr.Pos != test.expectedPos {
+				t.Errorf("expected: '%d', got: '%d'", test.expectedPos, parseErr.Pos)
+			}
+		})
+	}
+}
+
+func Test_filterMatches(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return model.GetMillisForTime(now.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+
+	user := &model.User{
+		Id:          model.NewId(),
+		Email:       "jane@old.example.com",
+		AuthService: model.UserAuthServiceSaml,
+		Roles:       model.SystemUserRoleId,
+		CreateAt:    daysAgo(400),
+	}
+	lookups := &filterLookups{
+		now:            now,
+		lastActivity:   map[string]int64{user.Id: daysAgo(200)},
+		teamMembers:    map[string]map[string]bool{"core": {}, "sales": {user.Id: true}},
+		channelMembers: map[string]map[string]bool{},
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+	}{{
+		expression: `auth=saml AND last_active<180d AND email~"@old\.example\.com$" AND NOT team:core`,
+		expected:   true,
+	}, {
+		expression: "last_active>180d",
+		expected:   false,
+	}, {
+		expression: "EMAIL=Jane@Old.Example.com",
+		expected:   true,
+	}, {
+		expression: "auth=email OR team:sales",
+		expected:   true,
+	}, {
+		expression: "NOT (auth=saml OR team:core)",
+		expected:   false,
+	}, {
+		expression: "role=system_user AND role!=system_guest",
+		expected:   true,
+	}, {
+		expression: "deactivated<1d",
+		expected:   false,
+	}, {
+		expression: "active=true AND created<2024-01-01",
+		expected:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := parseFilter(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			got := filter.matches(user, lookups)
+			if got != test.expected {
+				t.Errorf("expected: '%t', got: '%t'", test.expected, got)
+			}
+		})
+	}
+}
+
+func Test_describeFilterError(t *testing.T) {
+	command := "/bulk-user-delete dry-run filter auth=saml AND"
+	expression, offset := commandRemainder(command, 3)
+	_, err := parseFilter(expression)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := "invalid filter: expected a condition but found end of filter at position 47:\n```\n" +
+		command + "\n" + "                                              ^\n```"
+	if got := describeFilterError(command, offset, err); got != expected {
+		t.Errorf("expected: '%s', got: '%s'", expected, got)
+	}
+}
+
+func Test_pushDownFilter(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   userQuery
+	}{{
+		expression: "auth=SAML AND active=false AND role=system_guest",
+		expected:   userQuery{InactiveOnly: true, Role: "system_guest", AuthService: "saml"},
+	}, {
+		expression: "auth=email AND last_active<90d",
+		expected:   userQuery{},
+	}, {
+		expression: "auth=saml OR active=false",
+		expected:   userQuery{},
+	}, {
+		expression: "NOT auth=saml AND (role=system_guest AND auth!=ldap)",
+		expected:   userQuery{Role: "system_guest"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := parseFilter(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			got := pushDownFilter(filter)
+			if got.InactiveOnly != test.expected.InactiveOnly || got.Role != test.expected.Role || got.AuthService != test.expected.AuthService {
+				t.Errorf("expected: '%+v', got: '%+v'", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+// selectExpiredGuests returns the guests that were deactivated or last
+// active at least expiryDays ago, or that don't belong to any channel. Guests
+// created within expiryDays are never selected, so newly invited guests
+// aren't removed before they're added to their channels.
+func selectExpiredGuests(users []*model.User, lastActivity map[string]int64, inChannels map[string]bool, now time.Time, expiryDays int) []*model.User {
+	cutoff := model.GetMillisForTime(now.Add(-time.Duration(expiryDays) * 24 * time.Hour))
+
+	var expired []*model.User
+	for _, user := range users {
+		if !user.IsGuest() || user.CreateAt > cutoff {
+			continue
+		}
+
+		switch {
+		case user.DeleteAt != 0:
+			if user.DeleteAt <= cutoff {
+				expired = append(expired, user)
+			}
+		case !inChannels[user.Id]:
+			expired = append(expired, user)
+		case lastActivity[user.Id] <= cutoff:
+			expired = append(expired, user)
+		}
+	}
+	return expired
+}
+
+// getExpiredGuests returns the IDs of the expired guests that match the
+// email filters.
+func (p *Plugin) getExpiredGuests() ([]string, error) {
+	config := p.getConfiguration()
+
+	db, err := getDatabase(p.pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing database: %s", err.Error())
+	}
+
+	query := emailQuery(false, config.TargetEmailAddressSuffixes(), config.TargetEmailAddresses())
+	query.Role = model.SystemGuestRoleId
+	now := time.Now()
+	return p.selectUserIDs(query, func(guests []*model.User) ([]*model.User, error) {
+		if len(guests) == 0 {
+			return nil, nil
+		}
+		userIDs := getUserIDs(guests)
+		lastActivity, err := getLastActivity(p.pluginClient, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		inChannels, err := getUsersInChannels(db, userIDs)
+		if err != nil {
+			return nil, err
+		}
+		return selectExpiredGuests(guests, lastActivity, inChannels, now, config.GuestExpiryDays), nil
+	})
+}
+
+// getLastActivity returns when each of the given users was last active.
+func getLastActivity(client *pluginapi.Client, userIDs []string) (map[string]int64, error) {
+	lastActivity := map[string]int64{}
+	for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+		end := start + userIDLookupBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		statuses, err := client.User.ListStatusesByIDs(userIDs[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to get user statuses: %s", err.Error())
+		}
+		for _, status := range statuses {
+			lastActivity[status.UserId] = status.LastActivityAt
+		}
+	}
+	return lastActivity, nil
+}
+
+// getUsersInChannels returns the set of the given users that belong to at
+// least one channel.
+func getUsersInChannels(db *database, userIDs []string) (map[string]bool, error) {
+	inChannels := map[string]bool{}
+	for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+		end := start + userIDLookupBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		queryString, args, err := sq.Select("DISTINCT UserId").
+			From("ChannelMembers").
+			Where(sq.Eq{"UserId": userIDs[start:end]}).
+			PlaceholderFormat(db.placeholder()).
+			ToSql()
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to build the channel members query: %s", err.Error())
+		}
+
+		ids, err := queryIDs(db, queryString, args...)
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to find channel members: %s", err.Error())
+		}
+		for _, id := range ids {
+			inChannels[id] = true
+		}
+	}
+	return inChannels, nil
+}
+
+// runScheduledGuestCleanup deletes the expired guests, if configured to.
+func (p *Plugin) runScheduledGuestCleanup() {
+	config := p.getConfiguration()
+	if !config.ScheduleGuestCleanup {
+		return
+	}
+	if config.ScheduledJobsChannelID == "" {
+		p.pluginClient.Log.Warn("Guest cleanup is scheduled, but no channel is configured for the report")
+		return
+	}
+
+	guests, err := p.getExpiredGuests()
+	if err != nil {
+		p.pluginClient.Log.Error("Unable to select expired guests", "error", err)
+		return
+	}
+	if len(guests) == 0 {
+		return
+	}
+
+	p.runBulkDeleteJob(false, p.botUserID, config.ScheduledJobsChannelID, guests, "")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_selectExpiredGuests(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return model.GetMillisForTime(now.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+
+	tests := []struct {
+		description  string
+		user         model.User
+		lastActivity int64
+		inChannels   bool
+		expected     bool
+	}{{
+		description:  "guest inactive for longer than the expiry should be selected",
+		user:         model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200)},
+		lastActivity: daysAgo(91),
+		inChannels:   true,
+		expected:     true,
+	}, {
+		description:  "guest active within the expiry should not be selected",
+		user:         model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200)},
+		lastActivity: daysAgo(10),
+		inChannels:   true,
+	}, {
+		description: "guest with no recorded activity should be selected",
+		user:        model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200)},
+		inChannels:  true,
+		expected:    true,
+	}, {
+		description:  "guest deactivated for longer than the expiry should be selected",
+		user:         model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200), DeleteAt: daysAgo(91)},
+		lastActivity: daysAgo(95),
+		inChannels:   true,
+		expected:     true,
+	}, {
+		description:  "guest deactivated within the expiry should not be selected",
+		user:         model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200), DeleteAt: daysAgo(10)},
+		lastActivity: daysAgo(95),
+	}, {
+		description:  "active guest in no channels should be selected",
+		user:         model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(200)},
+		lastActivity: daysAgo(1),
+		expected:     true,
+	}, {
+		description: "guest created within the expiry should not be selected",
+		user:        model.User{Roles: model.SystemGuestRoleId, CreateAt: daysAgo(5)},
+	}, {
+		description:  "inactive regular user should not be selected",
+		user:         model.User{Roles: model.SystemUserRoleId, CreateAt: daysAgo(200)},
+		lastActivity: daysAgo(91),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			test.user.Id = model.NewId()
+			lastActivity := map[string]int64{}
+			if test.lastActivity != 0 {
+				lastActivity[test.user.Id] = test.lastActivity
+			}
+			inChannels := map[string]bool{test.user.Id: test.inChannels}
+
+			got := len(selectExpiredGuests([]*model.User{&test.user}, lastActivity, inChannels, now, 90)) == 1
+			if got != test.expected {
+				t.Errorf("expected: '%t', got: '%t'", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+// HookManifestProp is the manifest prop a plugin sets to true to have its
+// HookRoute called around each batch of deleted users.
+const HookManifestProp = "bulk_user_delete_hooks"
+const HookRoute = "/bulk-user-delete/users"
+
+const defaultHookTimeout = 30 * time.Second
+
+const HookPhaseBeforeDelete = "before_delete"
+const HookPhaseAfterDelete = "after_delete"
+
+// hookRequest is the body posted to HookRoute. Plugins acknowledge it by
+// responding with 200 OK once they've cleaned up their data for the users.
+type hookRequest struct {
+	Phase   string   `json:"phase"`
+	JobID   string   `json:"job_id"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// pluginHookResult records how a plugin responded to the job's hook calls.
+type pluginHookResult struct {
+	PluginID  string
+	Confirmed int
+	Failed    int
+	LastError string
+}
+
+// pluginHooks notifies the plugins that declare HookManifestProp before and
+// after each batch of users is deleted.
+type pluginHooks struct {
+	pluginClient *pluginapi.Client
+	deletionJob  *job
+	timeout      time.Duration
+	pluginIDs    []string
+}
+
+func newPluginHooks(pluginClient *pluginapi.Client, deletionJob *job, timeout time.Duration) (*pluginHooks, error) {
+	manifests, err := pluginClient.Plugin.List()
+	if err != nil {
+		return nil, fmt.Errorf("error listing plugins: %s", err.Error())
+	}
+
+	var pluginIDs []string
+	for _, manifest := range manifests {
+		if enabled, ok := manifest.Props[HookManifestProp].(bool); !ok || !enabled {
+			continue
+		}
+		status, err := pluginClient.Plugin.GetPluginStatus(manifest.Id)
+		if err != nil || status.State != model.PluginStateRunning {
+			continue
+		}
+		pluginIDs = append(pluginIDs, manifest.Id)
+	}
+	sort.Strings(pluginIDs)
+
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	return &pluginHooks{
+		pluginClient: pluginClient,
+		deletionJob:  deletionJob,
+		timeout:      timeout,
+		pluginIDs:    pluginIDs,
+	}, nil
+}
+
+// notify calls every supporting plugin with the given batch of users and
+// records which plugins confirmed. A plugin that fails or times out doesn't
+// stop the job.
+func (h *pluginHooks) notify(phase string, users []*model.User) {
+	if len(h.pluginIDs) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(hookRequest{
+		Phase:   phase,
+		JobID:   h.deletionJob.ID,
+		UserIDs: getUserIDs(users),
+	})
+	if err != nil {
+		h.pluginClient.Log.Error("Unable to encode plugin hook request", "error", err)
+		return
+	}
+
+	for _, pluginID := range h.pluginIDs {
+		err := h.call(pluginID, body)
+		h.record(pluginID, err)
+		if err != nil {
+			h.pluginClient.Log.Warn("Plugin did not confirm user cleanup", "plugin_id", pluginID, "phase", phase, "error", err)
+		}
+	}
+}
+
+func (h *pluginHooks) call(pluginID string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, "/"+pluginID+HookRoute, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// The inter-plugin request can't be cancelled, so we stop waiting for it
+	// once the timeout passes.
+	responses := make(chan *http.Response, 1)
+	go func() {
+		responses <- h.pluginClient.Plugin.HTTP(request)
+	}()
+
+	select {
+	case response := <-responses:
+		if response == nil {
+			return fmt.Errorf("no response")
+		}
+		defer response.Body.Close()
+		_, _ = io.Copy(io.Discard, response.Body)
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("%d status code", response.StatusCode)
+		}
+		return nil
+	case <-time.After(h.timeout):
+		go func() {
+			if response := <-responses; response != nil {
+				response.Body.Close()
+			}
+		}()
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+}
+
+func (h *pluginHooks) record(pluginID string, err error) {
+	var result *pluginHookResult
+	for i := range h.deletionJob.PluginHooks {
+		if h.deletionJob.PluginHooks[i].PluginID == pluginID {
+			result = &h.deletionJob.PluginHooks[i]
+			break
+		}
+	}
+	if result == nil {
+		h.deletionJob.PluginHooks = append(h.deletionJob.PluginHooks, pluginHookResult{PluginID: pluginID})
+		result = &h.deletionJob.PluginHooks[len(h.deletionJob.PluginHooks)-1]
+	}
+
+	if err != nil {
+		result.Failed++
+		result.LastError = err.Error()
+		return
+	}
+	result.Confirmed++
+}
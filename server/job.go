@@ -2,26 +2,197 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
 )
 
-func (p *Plugin) runBulkDeleteJob(dryRun bool, runningUserID string, runningChannelID string, usersToDelete []*model.User, userListFileInfoID string) {
-	userCount := len(usersToDelete)
+const JobKeyPrefix = "com.mattermost.plugin-bulk-user-delete/job/"
+
+const JobStatusRunning = "running"
+const JobStatusFailed = "failed"
+const JobStatusIncomplete = "incomplete"
+const JobStatusComplete = "complete"
+
+// maxReportedRunChanges caps the playbook run changes listed in the status
+// post, which has a length limit. The job record keeps all of them.
+const maxReportedRunChanges = 50
+
+// job is the record of a live bulk deletion job, kept in the KV store so that
+// the job can be verified again after it has finished.
+type job struct {
+	ID        string
+	CreateAt  int64
+	Status    string
+	UserIDs   []string
+	Remaining []userReference
+
+	// PluginHooks records which plugins confirmed they cleaned up their
+	// own data for each batch of deleted users.
+	PluginHooks []pluginHookResult
+
+	// SkippedStages explains each cleanup stage that was skipped because
+	// it was disabled or has no data on this server.
+	SkippedStages []string
+
+	// BoardArchives records where each empty board was archived before
+	// it was deleted.
+	BoardArchives []boardArchive
+
+	// PlaybookRunChanges records each deleted user that was replaced as
+	// the owner, reporter or a checklist assignee of a playbook run.
+	PlaybookRunChanges []playbookRunChange
+
+	// UserExports records where each user's data was exported before they
+	// were deleted.
+	UserExports []userExport
+
+	// Profile names the profile the job ran, if any, and EnabledStages and
+	// DisabledStages the cleanup stages it enabled and disabled, so
+	// verification checks the same stages.
+	Profile        string
+	EnabledStages  []string
+	DisabledStages []string
+}
+
+func newJob(userIDs []string) *job {
+	return &job{
+		ID:       model.NewId(),
+		CreateAt: model.GetMillis(),
+		Status:   JobStatusRunning,
+		UserIDs:  userIDs,
+	}
+}
+
+// describeReport summarizes what the job did beyond deleting users, for the
+// job's status post.
+func (j *job) describeReport() string {
+	var report strings.Builder
+	if j.Profile != "" {
+		fmt.Fprintf(&report, "\nProfile: `%s`", j.Profile)
+	}
+	if len(j.SkippedStages) > 0 {
+		report.WriteString("\n\nSkipped cleanup stages:")
+		for _, reason := range j.SkippedStages {
+			fmt.Fprintf(&report, "\n- %s", reason)
+		}
+	}
+	if len(j.UserExports) > 0 {
+		var saved, uploaded, encrypted int
+		for _, export := range j.UserExports {
+			if export.Path != "" {
+				saved++
+			} else {
+				uploaded++
+			}
+			if export.Encrypted {
+				encrypted++
+			}
+		}
+		report.WriteString("\n\nUser data exports:")
+		if saved > 0 {
+			fmt.Fprintf(&report, "\n- %d saved to `%s`", saved, filepath.Dir(j.UserExports[0].Path))
+		}
+		if uploaded > 0 {
+			fmt.Fprintf(&report, "\n- %d uploaded as files", uploaded)
+		}
+		if encrypted > 0 {
+			fmt.Fprintf(&report, "\n- %d encrypted with the configured public key", encrypted)
+		}
+	}
+	if len(j.BoardArchives) > 0 {
+		report.WriteString("\n\nArchived boards:")
+		for _, archive := range j.BoardArchives {
+			fmt.Fprintf(&report, "\n- %s (`%s`): ", archive.Title, archive.BoardID)
+			if archive.Path != "" {
+				fmt.Fprintf(&report, "saved to `%s`", archive.Path)
+			} else {
+				fmt.Fprintf(&report, "file ID `%s`", archive.FileID)
+			}
+		}
+	}
+	if len(j.PlaybookRunChanges) > 0 {
+		report.WriteString("\n\nReassigned playbook run users:")
+		for i, change := range j.PlaybookRunChanges {
+			if i == maxReportedRunChanges {
+				fmt.Fprintf(&report, "\n- and %d more", len(j.PlaybookRunChanges)-i)
+				break
+			}
+			newUser := "unassigned"
+			if change.NewUserID != "" {
+				newUser = fmt.Sprintf("`%s`", change.NewUserID)
+			}
+			fmt.Fprintf(&report, "\n- %s (`%s`): %s `%s` replaced with %s", change.RunName, change.RunID, change.Field, change.UserID, newUser)
+		}
+	}
+	if len(j.PluginHooks) > 0 {
+		report.WriteString("\n\nPlugin cleanup hooks:")
+		for _, result := range j.PluginHooks {
+			fmt.Fprintf(&report, "\n- %s: confirmed %d/%d calls", result.PluginID, result.Confirmed, result.Confirmed+result.Failed)
+			if result.Failed > 0 {
+				fmt.Fprintf(&report, " (last error: %s)", result.LastError)
+			}
+		}
+	}
+	return report.String()
+}
+
+func saveJob(client *pluginapi.Client, deletionJob *job) error {
+	if _, err := client.KV.Set(JobKeyPrefix+deletionJob.ID, deletionJob); err != nil {
+		return fmt.Errorf("could not save job %s: %s", deletionJob.ID, err.Error())
+	}
+	return nil
+}
+
+// getJob returns the job with the given ID, or nil if there is no such job.
+func getJob(client *pluginapi.Client, jobID string) (*job, error) {
+	var deletionJob *job
+	if err := client.KV.Get(JobKeyPrefix+jobID, &deletionJob); err != nil {
+		return nil, fmt.Errorf("could not get job %s: %s", jobID, err.Error())
+	}
+	return deletionJob, nil
+}
+
+func (p *Plugin) runBulkDeleteJob(dryRun bool, runningUserID string, runningChannelID string, userIDs []string, userListName string) {
+	p.runProfileJob(nil, dryRun, runningUserID, runningChannelID, userIDs, userListName)
+}
+
+// runProfileJob runs a bulk deletion job with the cleanup options of the
+// given profile, or of the plugin settings if the profile is nil. If
+// userListName isn't empty, the list of target users is attached to the
+// status post under that name.
+func (p *Plugin) runProfileJob(profile *cleanupProfile, dryRun bool, runningUserID string, runningChannelID string, userIDs []string, userListName string) {
+	config := p.getConfiguration()
+	if profile != nil {
+		config = config.withStages(profile.EnabledStages, profile.DisabledStages)
+	}
+
+	userCount := len(userIDs)
 	statusPost := &model.Post{
 		UserId:    runningUserID,
 		ChannelId: runningChannelID,
 		Message:   fmt.Sprintf("### Bulk user deletion job started\nDeleting %d users...", userCount),
 	}
 
-	if len(userListFileInfoID) > 0 {
-		statusPost.FileIds = model.StringArray{userListFileInfoID}
+	if userListName != "" && userCount > 0 {
+		userListFileID, err := uploadUserList(p.pluginClient, p.socketClient, runningChannelID, userIDs, userListName)
+		if err != nil {
+			p.pluginClient.Log.Error("Unable to upload list of target users", "error", err)
+			statusPost.Message = fmt.Sprintf("### Bulk user deletion job failed!\nUnable to upload list of target users: %s", err.Error())
+			if err = p.pluginClient.Post.CreatePost(statusPost); err != nil {
+				p.pluginClient.Log.Error("Unable to create status post", "error", err)
+			}
+			return
+		}
+		statusPost.FileIds = model.StringArray{userListFileID}
 	}
 
 	if dryRun {
 		statusPost.Message = fmt.Sprintf("### Bulk user deletion job finished\nDry-run targeted %d users and all empty channels, boards, and playbooks", userCount)
+		statusPost.Message += p.describeDryRunStages(config, userIDs)
 		err := p.pluginClient.Post.CreatePost(statusPost)
 		if err != nil {
 			p.pluginClient.Log.Error("Unable to create status post", "error", err)
@@ -49,8 +220,38 @@ func (p *Plugin) runBulkDeleteJob(dryRun bool, runningUserID string, runningChan
 		return
 	}
 
+	deletionJob := newJob(userIDs)
+	if profile != nil {
+		deletionJob.Profile = profile.Name
+		deletionJob.EnabledStages = profile.EnabledStages
+		deletionJob.DisabledStages = profile.DisabledStages
+	}
+	if err = saveJob(p.pluginClient, deletionJob); err != nil {
+		p.pluginClient.Log.Error("Could not save bulk delete job. Aborting...", "error", err)
+		reportError(p.pluginClient, statusPost, fmt.Errorf(
+			"could not save bulk delete job. Aborting: %s", err.Error()), userCount, 0)
+	} else {
+		p.runJob(deletionJob, statusPost, config)
+	}
+
+	// Set the job not running
+	_, err = p.pluginClient.KV.Set(RunningKey, false)
+	if err != nil {
+		p.pluginClient.Log.Error("Could not cleanup job status after run.", "error", err)
+		reportError(p.pluginClient, statusPost, fmt.Errorf(
+			"could not clean up job status after run: %s", err.Error()), userCount, userCount)
+		return
+	}
+}
+
+// runJob deletes the job's users, then verifies that none of their data
+// remains. The job is only marked complete if verification is clean.
+func (p *Plugin) runJob(deletionJob *job, statusPost *model.Post, config *configuration) {
+	userCount := len(deletionJob.UserIDs)
+
+	var err error
 	lastTime := time.Now()
-	if success := bulkDelete(p.pluginClient, p.socketClient, statusPost, usersToDelete, func(status int) {
+	if success := bulkDelete(p.pluginClient, p.socketClient, statusPost, deletionJob, config, func(status int) {
 		currTime := time.Now()
 		elapsed := currTime.Sub(lastTime)
 		// Only update the status post once per second
@@ -71,94 +272,326 @@ func (p *Plugin) runBulkDeleteJob(dryRun bool, runningUserID string, runningChan
 		if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
 			p.pluginClient.Log.Error("Unable to update status post", "error", err)
 		}
-	}); success {
-		statusPost.Message = fmt.Sprintf("### Bulk user deletion job finished\nDeleted %d users and cleaned up empty channels, boards, and playbooks.", userCount)
-		if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
-			p.pluginClient.Log.Error("Unable to update status post", "error", err)
+	}); !success {
+		deletionJob.Status = JobStatusFailed
+		if err = saveJob(p.pluginClient, deletionJob); err != nil {
+			p.pluginClient.Log.Error("Unable to save bulk delete job", "job", deletionJob.ID, "error", err)
 		}
+		return
 	}
 
-	// Set the job not running
-	_, err = p.pluginClient.KV.Set(RunningKey, false)
+	statusPost.Message = fmt.Sprintf("### Bulk user deletion job started\nDeleted %d users and cleaned up empty channels, boards, and playbooks. Verifying...", userCount)
+	if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
+		p.pluginClient.Log.Error("Unable to update status post", "error", err)
+	}
+
+	if err = p.verifyJob(deletionJob); err != nil {
+		p.pluginClient.Log.Error("Error verifying bulk delete job", "job", deletionJob.ID, "error", err)
+		statusPost.Message = fmt.Sprintf("### Bulk user deletion job incomplete\nDeleted %d users and cleaned up empty channels, boards, and playbooks, but verification failed: %s\nRun `/%s %s %s` to try again.",
+			userCount, err.Error(), Trigger, ModeVerify, deletionJob.ID)
+	} else if deletionJob.Status == JobStatusComplete {
+		statusPost.Message = fmt.Sprintf("### Bulk user deletion job finished\nDeleted %d users and cleaned up empty channels, boards, and playbooks. Verified that no data remains for the deleted users.\nJob ID: `%s`", userCount, deletionJob.ID)
+	} else {
+		statusPost.Message = fmt.Sprintf("### Bulk user deletion job incomplete\nDeleted %d users and cleaned up empty channels, boards, and playbooks, but %s\nRun `/%s %s %s` to check again.",
+			userCount, describeUserReferences(deletionJob.Remaining), Trigger, ModeVerify, deletionJob.ID)
+		p.replyWithUserReferences(statusPost, deletionJob.Remaining)
+	}
+	statusPost.Message += deletionJob.describeReport()
+	if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
+		p.pluginClient.Log.Error("Unable to update status post", "error", err)
+	}
+}
+
+// runVerifyJob re-runs verification for a previously started job and posts
+// the result to the given channel.
+func (p *Plugin) runVerifyJob(runningUserID string, runningChannelID string, deletionJob *job) {
+	resultPost := &model.Post{
+		UserId:    runningUserID,
+		ChannelId: runningChannelID,
+	}
+
+	if err := p.verifyJob(deletionJob); err != nil {
+		p.pluginClient.Log.Error("Error verifying bulk delete job", "job", deletionJob.ID, "error", err)
+		resultPost.Message = fmt.Sprintf("### Bulk user deletion verification failed\nJob `%s`: %s", deletionJob.ID, err.Error())
+	} else if deletionJob.Status == JobStatusComplete {
+		resultPost.Message = fmt.Sprintf("### Bulk user deletion verification finished\nJob `%s` is complete. No data remains for its %d deleted users.", deletionJob.ID, len(deletionJob.UserIDs))
+	} else {
+		resultPost.Message = fmt.Sprintf("### Bulk user deletion verification finished\nJob `%s` is incomplete: %s", deletionJob.ID, describeUserReferences(deletionJob.Remaining))
+		if fileID, err := p.uploadUserReferences(runningChannelID, deletionJob.Remaining); err != nil {
+			p.pluginClient.Log.Error("Unable to upload verification report", "error", err)
+		} else {
+			resultPost.FileIds = model.StringArray{fileID}
+		}
+	}
+
+	if err := p.pluginClient.Post.CreatePost(resultPost); err != nil {
+		p.pluginClient.Log.Error("Unable to create verification post", "error", err)
+	}
+}
+
+// verifyJob checks that none of the job's users have data left, then records
+// what remains and the resulting status on the job.
+func (p *Plugin) verifyJob(deletionJob *job) error {
+	config := p.getConfiguration().withStages(deletionJob.EnabledStages, deletionJob.DisabledStages)
+	env, err := newCleanupEnv(p.pluginClient, config, deletionJob.UserIDs)
 	if err != nil {
-		p.pluginClient.Log.Error("Could not cleanup job status after run.", "error", err)
-		reportError(p.pluginClient, statusPost, fmt.Errorf(
-			"could not clean up job status after run: %s", err.Error()), userCount, userCount)
+		return err
+	}
+
+	stages, _ := selectCleanupStages(env)
+	remaining, err := verifyDeletion(env, stages, env.config.VerifyWithSchemaScan)
+	if err != nil {
+		return err
+	}
+
+	deletionJob.Remaining = remaining
+	deletionJob.Status = JobStatusComplete
+	if len(remaining) > 0 {
+		deletionJob.Status = JobStatusIncomplete
+	}
+	return saveJob(p.pluginClient, deletionJob)
+}
+
+func describeUserReferences(references []userReference) string {
+	var rowCount int64
+	for _, reference := range references {
+		rowCount += reference.Count
+	}
+	return fmt.Sprintf("%d rows in %d table columns still reference deleted users.", rowCount, len(references))
+}
+
+// replyWithUserReferences replies to the status post with a CSV report of the
+// data still referencing deleted users.
+func (p *Plugin) replyWithUserReferences(statusPost *model.Post, references []userReference) {
+	fileID, err := p.uploadUserReferences(statusPost.ChannelId, references)
+	if err != nil {
+		p.pluginClient.Log.Error("Unable to upload verification report", "error", err)
 		return
 	}
+
+	replyPost := &model.Post{
+		UserId:    statusPost.UserId,
+		ChannelId: statusPost.ChannelId,
+		RootId:    statusPost.Id,
+		Message:   "Data still referencing deleted users:",
+		FileIds:   model.StringArray{fileID},
+	}
+	if err := p.pluginClient.Post.CreatePost(replyPost); err != nil {
+		p.pluginClient.Log.Error("Unable to create verification report post", "error", err)
+	}
 }
 
-func bulkDelete(pluginClient *pluginapi.Client, socketClient *model.Client4, statusPost *model.Post, usersToDelete []*model.User, reportProgress func(int)) bool {
-	db, err := pluginClient.Store.GetMasterDB()
+func (p *Plugin) uploadUserReferences(channelID string, references []userReference) (string, error) {
+	report, err := formatUserReferences(references)
+	if err != nil {
+		return "", err
+	}
+
+	reportFileInfo, err := p.pluginClient.File.Upload(strings.NewReader(report),
+		fmt.Sprintf("%d-remaining-user-references-bulk-delete.csv", time.Now().Unix()), channelID)
+	if err != nil {
+		return "", err
+	}
+	return reportFileInfo.Id, nil
+}
+
+func bulkDelete(pluginClient *pluginapi.Client, socketClient *model.Client4, statusPost *model.Post, deletionJob *job, config *configuration, reportProgress func(int)) bool {
+	userIDs := deletionJob.UserIDs
+	env, err := newCleanupEnv(pluginClient, config, deletionJob.UserIDs)
 	if err != nil {
 		pluginClient.Log.Error("Error accessing database", "error", err)
 		reportError(pluginClient, statusPost, fmt.Errorf(
-			"error accessing database to find empty channels: %s", err.Error()), len(usersToDelete), 0)
+			"error accessing database to find empty channels: %s", err.Error()), len(userIDs), 0)
 		return false
 	}
+	env.deletionJob = deletionJob
+	env.statusPost = statusPost
 
-	// Delete the specified users and all related user data.
-	if count, err := purgeUsers(db, pluginClient, socketClient, usersToDelete, reportProgress); err != nil {
-		pluginClient.Log.Error("Error deleting users", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf(
-			"error deleting users: %s", err.Error()), len(usersToDelete), count)
-		return false
+	// Find out which cleanup stages apply to this server before deleting
+	// anything, so a missing table can't fail the job halfway through.
+	stages, skipped := selectCleanupStages(env)
+	for _, reason := range skipped {
+		pluginClient.Log.Info("Skipping cleanup stage", "reason", reason)
+	}
+	deletionJob.SkippedStages = skipped
+	for _, stage := range stages {
+		if err = stage.Prepare(env); err != nil {
+			pluginClient.Log.Error("Error preparing cleanup stage", "stage", stage.Name(), "error", err)
+			reportError(pluginClient, statusPost, fmt.Errorf(
+				"error preparing cleanup stage %s: %s", stage.Name(), err.Error()), len(userIDs), 0)
+			return false
+		}
 	}
 
-	// Delete board members that no longer exist in the user table
-	if err := purgeDanglingBoardMembers(db); err != nil {
-		pluginClient.Log.Error("Error removing users from board members list", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing users from board members list: %s", err.Error()), len(usersToDelete), len(usersToDelete))
+	// Custom cleanup rules were validated when saved, but the schema may
+	// have changed since.
+	rules, err := parseCleanupRules(config.CustomCleanupRules)
+	if err == nil {
+		err = validateCleanupRulesSchema(env.db, rules)
+	}
+	if err != nil {
+		pluginClient.Log.Error("Invalid custom cleanup rules", "error", err)
+		reportError(pluginClient, statusPost, fmt.Errorf(
+			"invalid custom cleanup rules: %s", err.Error()), len(userIDs), 0)
 		return false
 	}
 
-	// Delete boards that have no members
-	if err := purgeEmptyBoards(db, pluginClient); err != nil {
-		pluginClient.Log.Error("Error removing empty boards", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing empty boards: %s", err.Error()), len(usersToDelete), len(usersToDelete))
-		return false
+	if config.ExportUsersBeforeDeletion && config.UserExportPublicKey != "" {
+		if _, err = parseExportPublicKey(config.UserExportPublicKey); err != nil {
+			pluginClient.Log.Error("Invalid user export public key", "error", err)
+			reportError(pluginClient, statusPost, err, len(userIDs), 0)
+			return false
+		}
+	}
+	if config.ExportUsersBeforeDeletion {
+		if err = config.checkExportUploads(); err != nil {
+			pluginClient.Log.Error("Unencrypted user export uploads are not allowed", "error", err)
+			reportError(pluginClient, statusPost, err, len(userIDs), 0)
+			return false
+		}
 	}
 
-	// Delete playbook members that no longer exist in the user table
-	if err := purgeDanglingPlaybookMembers(db); err != nil {
-		pluginClient.Log.Error("Error removing users from playbook members list", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing users from playbook members list: %s", err.Error()), len(usersToDelete), len(usersToDelete))
+	hooks, err := newPluginHooks(pluginClient, deletionJob, time.Duration(config.PluginHookTimeoutSeconds)*time.Second)
+	if err != nil {
+		pluginClient.Log.Error("Error finding plugins to notify", "error", err)
+		reportError(pluginClient, statusPost, fmt.Errorf(
+			"error finding plugins to notify: %s", err.Error()), len(userIDs), 0)
 		return false
 	}
 
-	// Delete playbook runs with no members
-	if err := purgeRunsForEmptyPlaybooks(db); err != nil {
-		pluginClient.Log.Error("Error removing empty playbook runs", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing empty playbook runs: %s", err.Error()), len(usersToDelete), len(usersToDelete))
-		return false
+	// With the set-based post purge, the posts of deleted users are purged
+	// together once enough users are pending.
+	var pendingPostPurge []string
+	flushPostPurge := func() error {
+		if len(pendingPostPurge) == 0 {
+			return nil
+		}
+		if err := purgeDanglingPosts(env.db, pendingPostPurge, config.postPurgeRowLimit()); err != nil {
+			return fmt.Errorf("error purging dangling posts: %s", err.Error())
+		}
+		pendingPostPurge = nil
+		// The purged posts' persistent notifications are left behind.
+		return purgeOrphanedPersistentNotifications(env.db, env.tables)
 	}
 
-	// Delete playbooks with no members
-	if err := purgeEmptyPlaybooks(db); err != nil {
-		pluginClient.Log.Error("Error removing empty playbooks", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing empty playbooks: %s", err.Error()), len(usersToDelete), len(usersToDelete))
-		return false
+	// Delete the specified users and all related user data, a batch at a
+	// time so other plugins can clean up their own data for each batch.
+	for start := 0; start < len(userIDs); start += userBatchSize {
+		end := start + userBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		// Users are loaded a batch at a time. Users deleted since the job
+		// started are left out of the batch.
+		batch, err := loadUsers(socketClient, userIDs[start:end])
+		if err != nil {
+			pluginClient.Log.Error("Error loading users", "error", err)
+			reportError(pluginClient, statusPost, err, len(userIDs), start)
+			return false
+		}
+
+		// Export the batch first, so no user is deleted without a snapshot
+		// of their data.
+		if config.ExportUsersBeforeDeletion {
+			if err := exportUsers(env, batch); err != nil {
+				pluginClient.Log.Error("Error exporting users", "error", err)
+				reportError(pluginClient, statusPost, err, len(userIDs), start)
+				return false
+			}
+		}
+
+		hooks.notify(HookPhaseBeforeDelete, batch)
+		dropDeletionRequests(pluginClient, batch)
+		count, err := purgeUsers(env.db, env.tables, rules, pluginClient, socketClient, batch, config.deletionWorkers(), !config.SetBasedPostPurge, func(status int) {
+			reportProgress(start + status)
+		})
+		if config.SetBasedPostPurge {
+			// Only posts of users that no longer exist are purged, so the
+			// whole batch is queued even if some deletions failed.
+			for _, user := range batch {
+				pendingPostPurge = append(pendingPostPurge, user.Id)
+			}
+		}
+		// Persistent notifications of the deleted users' posts are removed
+		// once per batch, even if some deletions failed.
+		if notificationsErr := purgeOrphanedPersistentNotifications(env.db, env.tables); notificationsErr != nil {
+			pluginClient.Log.Error("Error deleting persistent notifications", "error", notificationsErr)
+			if err == nil {
+				reportError(pluginClient, statusPost, notificationsErr, len(userIDs), start+count)
+				return false
+			}
+		}
+		if err != nil {
+			pluginClient.Log.Error("Error deleting users", "error", err)
+			if flushErr := flushPostPurge(); flushErr != nil {
+				pluginClient.Log.Error("Error purging dangling posts", "error", flushErr)
+			}
+			reportError(pluginClient, statusPost, fmt.Errorf(
+				"error deleting users: %s", err.Error()), len(userIDs), start+count)
+			return false
+		}
+		hooks.notify(HookPhaseAfterDelete, batch)
+
+		if len(pendingPostPurge) >= config.postPurgeBatchSize() || end == len(userIDs) {
+			if err := flushPostPurge(); err != nil {
+				pluginClient.Log.Error("Error purging dangling posts", "error", err)
+				reportError(pluginClient, statusPost, err, len(userIDs), end)
+				return false
+			}
+		}
 	}
 
-	// Delete miscellaneous data related to deleted playbooks
-	if err := purgeDanglingPlaybookData(db); err != nil {
-		pluginClient.Log.Error("Error removing dangling playbook data", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error removing dangling playbook data: %s", err.Error()), len(usersToDelete), len(usersToDelete))
-		return false
+	for _, stage := range stages {
+		if err := stage.Purge(env); err != nil {
+			pluginClient.Log.Error("Error running cleanup stage", "stage", stage.Name(), "error", err)
+			reportError(pluginClient, statusPost, err, len(userIDs), len(userIDs))
+			return false
+		}
 	}
 
 	// Delete all empty channels. The expectation is that empty channels were
 	// channels that previously had users in them - we just deleted them.
-	if err := purgeEmptyChannels(db, pluginClient, socketClient); err != nil {
+	if err := purgeEmptyChannels(env.db, pluginClient, socketClient); err != nil {
 		pluginClient.Log.Error("Error deleting empty channels", "error", err)
-		reportError(pluginClient, statusPost, fmt.Errorf("error deleting empty channels: %s", err.Error()), len(usersToDelete), len(usersToDelete))
+		reportError(pluginClient, statusPost, fmt.Errorf("error deleting empty channels: %s", err.Error()), len(userIDs), len(userIDs))
 		return false
 	}
 
-	pluginClient.Log.Info("Finished bulk deletion", "userDeletionCount", len(usersToDelete))
+	pluginClient.Log.Info("Finished bulk deletion", "userDeletionCount", len(userIDs))
 	return true
 }
 
+// describeDryRunStages reports what each cleanup stage would remove if the
+// given users were deleted.
+func (p *Plugin) describeDryRunStages(config *configuration, userIDs []string) string {
+	env, err := newCleanupEnv(p.pluginClient, config, userIDs)
+	if err != nil {
+		p.pluginClient.Log.Error("Error accessing database", "error", err)
+		return fmt.Sprintf("\n\nUnable to check cleanup stages: %s", err.Error())
+	}
+
+	var report strings.Builder
+	report.WriteString("\n\nCleanup stages:")
+	stages, skipped := selectCleanupStages(env)
+	for _, stage := range stages {
+		if err := stage.Prepare(env); err != nil {
+			fmt.Fprintf(&report, "\n- %s: the job would fail: %s", stage.Name(), err.Error())
+			continue
+		}
+		count, err := stage.DryRunCount(env)
+		if err != nil {
+			p.pluginClient.Log.Error("Error counting cleanup stage records", "stage", stage.Name(), "error", err)
+			fmt.Fprintf(&report, "\n- %s: unable to count records: %s", stage.Name(), err.Error())
+			continue
+		}
+		fmt.Fprintf(&report, "\n- %s: %d %s", stage.Name(), count, stage.DryRunLabel())
+	}
+	for _, reason := range skipped {
+		fmt.Fprintf(&report, "\n- skipped %s", reason)
+	}
+	return report.String()
+}
+
 func reportError(pluginClient *pluginapi.Client, statusPost *model.Post, err error, totalDeletionCount, currDeletionCount int) {
 	statusPost.Message = fmt.Sprintf("### Bulk user deletion job failed!\n%s\nDeleted %d/%d users.", err.Error(), currDeletionCount, totalDeletionCount)
 	if err := pluginClient.Post.UpdatePost(statusPost); err != nil {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// selectLDAPRemovedUsers returns the LDAP users that were deactivated at
+// least delayDays ago.
+//
+// Active users whose AuthData no longer resolves in the directory are not
+// selected. The plugin API doesn't expose the results of the last LDAP sync,
+// and a live directory lookup can't tell a removed user from a failed lookup,
+// so deleting them would risk deleting users during a directory outage. LDAP
+// sync deactivates those users itself, after which they are selected once the
+// delay has passed.
+func selectLDAPRemovedUsers(users []*model.User, now time.Time, delayDays int) []*model.User {
+	cutoff := model.GetMillisForTime(now.Add(-time.Duration(delayDays) * 24 * time.Hour))
+
+	var removed []*model.User
+	for _, user := range users {
+		if user.AuthService != model.UserAuthServiceLdap || user.IsBot {
+			continue
+		}
+		// We can't permanently delete system administrators
+		if user.IsInRole(model.SystemAdminRoleId) {
+			continue
+		}
+		if user.DeleteAt == 0 || user.DeleteAt > cutoff {
+			continue
+		}
+		removed = append(removed, user)
+	}
+	return removed
+}
+
+// runScheduledLDAPDeletion deletes the users removed from LDAP, if
+// configured to.
+func (p *Plugin) runScheduledLDAPDeletion() {
+	config := p.getConfiguration()
+	if !config.ScheduleLDAPDeletion {
+		return
+	}
+	if config.ScheduledJobsChannelID == "" {
+		p.pluginClient.Log.Warn("LDAP deletion is scheduled, but no channel is configured for the report")
+		return
+	}
+
+	users, err := p.selectTargetUsers(UsersLDAP, "")
+	if err != nil {
+		p.pluginClient.Log.Error("Unable to select users removed from LDAP", "error", err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	p.runBulkDeleteJob(false, p.botUserID, config.ScheduledJobsChannelID, users, "")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_selectLDAPRemovedUsers(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) int64 {
+		return model.GetMillisForTime(now.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+
+	tests := []struct {
+		description string
+		user        model.User
+		expected    bool
+	}{{
+		description: "LDAP user deactivated before the delay should be selected",
+		user:        model.User{AuthService: model.UserAuthServiceLdap, DeleteAt: daysAgo(31)},
+		expected:    true,
+	}, {
+		description: "LDAP user deactivated within the delay should not be selected",
+		user:        model.User{AuthService: model.UserAuthServiceLdap, DeleteAt: daysAgo(29)},
+	}, {
+		description: "active LDAP user should not be selected",
+		user:        model.User{AuthService: model.UserAuthServiceLdap},
+	}, {
+		description: "deactivated email user should not be selected",
+		user:        model.User{DeleteAt: daysAgo(31)},
+	}, {
+		description: "deactivated LDAP system admin should not be selected",
+		user:        model.User{AuthService: model.UserAuthServiceLdap, DeleteAt: daysAgo(31), Roles: model.SystemAdminRoleId},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := len(selectLDAPRemovedUsers([]*model.User{&test.user}, now, 30)) == 1
+			if got != test.expected {
+				t.Errorf("expected: '%t', got: '%t'", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"text/template"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const BotUsername = "bulk-user-delete"
+const BotDisplayName = "Bulk User Delete"
+
+const maxReportedNoticeFailures = 50
+
+// defaultNoticeTemplate is used when no notice template is configured.
+const defaultNoticeTemplate = `Hi {{.Username}},
+
+Your account has been deactivated and will be permanently deleted on {{.DeletionDate}}.{{if .ContestURL}}
+
+If you think this is a mistake, let us know at {{.ContestURL}} before then.{{end}}`
+
+// noticeData is the data available to the notice template.
+type noticeData struct {
+	Username     string
+	FirstName    string
+	LastName     string
+	Email        string
+	DeletionDate string
+	ContestURL   string
+}
+
+// noticeResults summarizes the advance notices sent by a stage job.
+type noticeResults struct {
+	DirectMessages int
+	Emails         int
+	Failures       []string
+	// EmailDisabled is set when the server doesn't send email, so notices
+	// were only sent as direct messages.
+	EmailDisabled bool
+}
+
+// parseNoticeTemplate parses the configured notice template, falling back to
+// the default.
+func parseNoticeTemplate(text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" {
+		text = defaultNoticeTemplate
+	}
+	noticeTemplate, err := template.New("notice").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notice template: %s", err.Error())
+	}
+	return noticeTemplate, nil
+}
+
+func renderNotice(noticeTemplate *template.Template, data noticeData) (string, error) {
+	var notice bytes.Buffer
+	if err := noticeTemplate.Execute(&notice, data); err != nil {
+		return "", fmt.Errorf("unable to render notice: %s", err.Error())
+	}
+	return notice.String(), nil
+}
+
+// noticeSender sends staged users a direct message from the bot and, if the
+// server sends email, an email with the date they will be deleted.
+type noticeSender struct {
+	plugin     *Plugin
+	template   *template.Template
+	contestURL string
+	sendEmail  bool
+	results    *noticeResults
+}
+
+func (p *Plugin) newNoticeSender() (*noticeSender, error) {
+	config := p.getConfiguration()
+	noticeTemplate, err := parseNoticeTemplate(config.NoticeTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	emailSettings := p.pluginClient.Configuration.GetConfig().EmailSettings
+	sendEmail := emailSettings.SendEmailNotifications != nil && *emailSettings.SendEmailNotifications
+	return &noticeSender{
+		plugin:     p,
+		template:   noticeTemplate,
+		contestURL: config.NoticeContestURL,
+		sendEmail:  sendEmail,
+		results:    &noticeResults{EmailDisabled: !sendEmail},
+	}, nil
+}
+
+// send notifies the user of their deletion date. It must be called before
+// the user is deactivated, so they can still read the direct message.
+// Delivery failures are recorded in the results rather than returned.
+func (s *noticeSender) send(user *model.User, deleteAt int64) error {
+	if user.IsBot {
+		return nil
+	}
+
+	deletionDate := model.GetTimeForMillis(deleteAt).UTC().Format("January 2, 2006")
+	notice, err := renderNotice(s.template, noticeData{
+		Username:     user.Username,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		Email:        user.Email,
+		DeletionDate: deletionDate,
+		ContestURL:   s.contestURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendDirectMessage(user, notice); err != nil {
+		s.plugin.pluginClient.Log.Warn("Unable to send deletion notice", "user_id", user.Id, "error", err)
+		s.results.Failures = append(s.results.Failures, fmt.Sprintf("@%s direct message: %s", user.Username, err.Error()))
+	} else {
+		s.results.DirectMessages++
+	}
+
+	if !s.sendEmail || user.Email == "" {
+		return nil
+	}
+	subject := fmt.Sprintf("Your account will be deleted on %s", deletionDate)
+	body := strings.ReplaceAll(html.EscapeString(notice), "\n", "<br>")
+	if err := s.plugin.pluginClient.Mail.Send(user.Email, subject, body); err != nil {
+		s.plugin.pluginClient.Log.Warn("Unable to email deletion notice", "user_id", user.Id, "error", err)
+		s.results.Failures = append(s.results.Failures, fmt.Sprintf("@%s email: %s", user.Username, err.Error()))
+		return nil
+	}
+	s.results.Emails++
+	return nil
+}
+
+func (s *noticeSender) sendDirectMessage(user *model.User, notice string) error {
+	channel, err := s.plugin.pluginClient.Channel.GetDirect(s.plugin.botUserID, user.Id)
+	if err != nil {
+		return err
+	}
+	return s.plugin.pluginClient.Post.CreatePost(&model.Post{
+		UserId:    s.plugin.botUserID,
+		ChannelId: channel.Id,
+		Message:   notice,
+	})
+}
+
+// describe summarizes the delivery of the notices for a job's status post.
+func (r *noticeResults) describe() string {
+	var report strings.Builder
+	if r.EmailDisabled {
+		fmt.Fprintf(&report, "\n\nAdvance notices: sent %d direct messages. No emails were sent, because the server doesn't send email notifications.", r.DirectMessages)
+	} else {
+		fmt.Fprintf(&report, "\n\nAdvance notices: sent %d direct messages and %d emails.", r.DirectMessages, r.Emails)
+	}
+	if len(r.Failures) > 0 {
+		report.WriteString("\nFailed deliveries:")
+		for i, failure := range r.Failures {
+			if i == maxReportedNoticeFailures {
+				fmt.Fprintf(&report, "\n- and %d more", len(r.Failures)-i)
+				break
+			}
+			fmt.Fprintf(&report, "\n- %s", failure)
+		}
+	}
+	return report.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_renderNotice(t *testing.T) {
+	data := noticeData{
+		Username:     "jdoe",
+		DeletionDate: "March 1, 2026",
+		ContestURL:   "https://example.com/contest",
+	}
+
+	tests := []struct {
+		description string
+		template    string
+		expected    string
+		expectErr   bool
+	}{{
+		description: "empty template should use the default",
+		expected:    "Hi jdoe,\n\nYour account has been deactivated and will be permanently deleted on March 1, 2026.\n\nIf you think this is a mistake, let us know at https://example.com/contest before then.",
+	}, {
+		description: "custom template should be rendered",
+		template:    "{{.Username}} goes on {{.DeletionDate}}",
+		expected:    "jdoe goes on March 1, 2026",
+	}, {
+		description: "unknown field should fail",
+		template:    "{{.Manager}}",
+		expectErr:   true,
+	}, {
+		description: "invalid template should fail",
+		template:    "{{.Username",
+		expectErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			noticeTemplate, err := parseNoticeTemplate(test.template)
+			var got string
+			if err == nil {
+				got, err = renderNotice(noticeTemplate, data)
+			}
+			if test.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if got != test.expected {
+				t.Errorf("expected: '%s', got: '%s'", test.expected, got)
+			}
+		})
+	}
+}
+
+func Test_noticeResults_describe(t *testing.T) {
+	tests := []struct {
+		description string
+		results     noticeResults
+		expected    string
+	}{{
+		description: "delivered notices should be counted",
+		results:     noticeResults{DirectMessages: 4, Emails: 3},
+		expected:    "\n\nAdvance notices: sent 4 direct messages and 3 emails.",
+	}, {
+		description: "failed deliveries should be listed",
+		results:     noticeResults{DirectMessages: 1, Emails: 1, Failures: []string{"@jdoe email: timeout", "@asmith direct message: not found"}},
+		expected:    "\n\nAdvance notices: sent 1 direct messages and 1 emails.\nFailed deliveries:\n- @jdoe email: timeout\n- @asmith direct message: not found",
+	}, {
+		description: "disabled email should be reported",
+		results:     noticeResults{DirectMessages: 2, EmailDisabled: true},
+		expected:    "\n\nAdvance notices: sent 2 direct messages. No emails were sent, because the server doesn't send email notifications.",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.results.describe(); got != test.expected {
+				t.Errorf("expected: '%s', got: '%s'", test.expected, got)
+			}
+		})
+	}
+}
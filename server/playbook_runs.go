@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const playbookRunPageSize = 500
+
+// playbookRunsStage deletes the playbook runs that deleted users leave
+// without an owner or any participants, then reassigns the owners, reporters
+// and checklist item assignees of remaining runs that reference deleted
+// users, which the playbooks UI can't display.
+type playbookRunsStage struct{}
+
+func (playbookRunsStage) Name() string {
+	return "playbook-runs"
+}
+
+func (playbookRunsStage) IsApplicable(env *cleanupEnv) (bool, string) {
+	return detectIntegration(env, playbooksIntegration)
+}
+
+func (playbookRunsStage) DryRunLabel() string {
+	return "abandoned runs would be deleted or run users reassigned"
+}
+
+func (playbookRunsStage) DryRunCount(env *cleanupEnv) (int, error) {
+	targeted := map[string]bool{}
+	for _, id := range env.userIDs {
+		targeted[id] = true
+	}
+
+	abandonedIDs, err := findAbandonedRuns(env.db, env.userIDs)
+	if err != nil {
+		return 0, err
+	}
+	abandoned := map[string]bool{}
+	for _, id := range abandonedIDs {
+		abandoned[id] = true
+	}
+
+	count := len(abandonedIDs)
+	err = forEachPlaybookRun(env.db, func(runs []*playbookRun) error {
+		for _, run := range runs {
+			if abandoned[run.ID] {
+				continue
+			}
+			changes, err := remapRunUsers(run, func(userID string) bool { return targeted[userID] }, "")
+			if err != nil {
+				return err
+			}
+			count += len(changes)
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (playbookRunsStage) Prepare(env *cleanupEnv) error {
+	if env.config.PlaybooksFallbackUsername == "" {
+		return nil
+	}
+	fallbackUserID, err := resolveReplacementUser(env, "playbooks fallback user", env.config.PlaybooksFallbackUsername)
+	if err != nil {
+		return err
+	}
+	env.playbooksFallbackUserID = fallbackUserID
+	return nil
+}
+
+func (playbookRunsStage) Purge(env *cleanupEnv) error {
+	if err := purgeAbandonedRuns(env.db, env.userIDs); err != nil {
+		return fmt.Errorf("error removing abandoned playbook runs: %s", err.Error())
+	}
+
+	if err := remapDanglingRunUsers(env, env.playbooksFallbackUserID); err != nil {
+		return fmt.Errorf("error reassigning playbook run users: %s", err.Error())
+	}
+	return nil
+}
+
+func (playbookRunsStage) Verify(env *cleanupEnv) ([]userReference, error) {
+	references, err := verifyTableColumns(env, []tableColumn{
+		{"ir_incident", "commanderuserid"},
+		{"ir_incident", "reporteruserid"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Checklist assignees are kept in a JSON column, so check them here
+	// rather than with a query.
+	targeted := map[string]bool{}
+	for _, id := range env.userIDs {
+		targeted[id] = true
+	}
+	assignees := map[string]int64{}
+	err = forEachPlaybookRun(env.db, func(runs []*playbookRun) error {
+		for _, run := range runs {
+			changes, err := remapRunUsers(run, func(userID string) bool { return targeted[userID] }, "")
+			if err != nil {
+				return err
+			}
+			for _, change := range changes {
+				if change.Field != "owner" && change.Field != "reporter" {
+					assignees[change.UserID]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for userID, count := range assignees {
+		references = append(references, userReference{
+			Table:  env.tables["ir_incident"],
+			Column: "checklistsjson",
+			UserID: userID,
+			Count:  count,
+		})
+	}
+	return references, nil
+}
+
+// playbookRun holds the user references of a playbook run.
+type playbookRun struct {
+	ID             string
+	Name           string
+	OwnerUserID    string
+	ReporterUserID string
+	Checklists     string
+}
+
+// playbookRunChange records a deleted user that was replaced in a run.
+type playbookRunChange struct {
+	RunID     string
+	RunName   string
+	Field     string
+	UserID    string
+	NewUserID string
+}
+
+// getRunMemberships returns the owner and participants of a playbook run.
+// Newer playbooks versions also keep followers in ir_run_participants, and
+// mark participants with isparticipant.
+func getRunMemberships(db *database) ([]membership, error) {
+	participants := membership{Table: "ir_run_participants", ContainerColumn: "incidentid", UserColumn: "userid"}
+	columns, err := getTableColumns(db, "ir_run_participants")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := columns["isparticipant"]; ok {
+		participants.Condition = sq.Eq{"isparticipant": true}
+	}
+
+	return []membership{
+		{Table: "ir_incident", ContainerColumn: "id", UserColumn: "commanderuserid"},
+		participants,
+	}, nil
+}
+
+// findAbandonedRuns returns the runs, including those started without a
+// playbook, owned by or with a participant among the given users, whose
+// owner and other participants have all been deleted. The given users are
+// treated as deleted already. Followers of a run don't keep it.
+func findAbandonedRuns(db *database, userIDs []string) ([]string, error) {
+	memberships, err := getRunMemberships(db)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find abandoned playbook runs: %s", err.Error())
+	}
+	left, err := findContainersLeftByUsers(db, memberships, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find abandoned playbook runs: %s", err.Error())
+	}
+
+	ids := make([]string, 0, len(left))
+	for id := range left {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// purgeAbandonedRuns deletes the runs the deleted users left without an
+// owner or participants.
+func purgeAbandonedRuns(db *database, userIDs []string) error {
+	ids, err := findAbandonedRuns(db, userIDs)
+	if err != nil {
+		return err
+	}
+
+	// Runs are deleted a page at a time to stay within the database's
+	// parameter limits.
+	for start := 0; start < len(ids); start += playbookRunPageSize {
+		end := start + playbookRunPageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := deleteRunsInTransaction(db, ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteRunsInTransaction(db *database, ids []string) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
+				rollbackErr.Error(), err.Error())
+		}
+	}()
+
+	if err = deleteRuns(tx, db, ids); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
+	}
+
+	return nil
+}
+
+// forEachPlaybookRun calls fn with every playbook run, a page at a time.
+func forEachPlaybookRun(db *database, fn func([]*playbookRun) error) error {
+	lastID := ""
+	for {
+		query := sq.Select("id", "name", "commanderuserid", "reporteruserid", "checklistsjson").
+			From("ir_incident").
+			Where(sq.Gt{"id": lastID}).
+			OrderBy("id").
+			Limit(playbookRunPageSize).
+			PlaceholderFormat(db.placeholder())
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the playbook runs query: %s", err.Error())
+		}
+
+		runs, err := queryPlaybookRuns(db, queryString, args...)
+		if err != nil {
+			return fmt.Errorf("error when trying to list playbook runs: %s", err.Error())
+		}
+		if len(runs) == 0 {
+			return nil
+		}
+
+		if err := fn(runs); err != nil {
+			return err
+		}
+		lastID = runs[len(runs)-1].ID
+	}
+}
+
+func queryPlaybookRuns(db *database, query string, args ...interface{}) ([]*playbookRun, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*playbookRun
+	for rows.Next() {
+		run := &playbookRun{}
+		var checklists []byte
+		if err := rows.Scan(&run.ID, &run.Name, &run.OwnerUserID, &run.ReporterUserID, &checklists); err != nil {
+			return nil, err
+		}
+		run.Checklists = string(checklists)
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// remapDanglingRunUsers replaces the users of each run that no longer exist
+// with the fallback user, or leaves them unassigned if fallbackUserID is
+// empty, and records each change on the job.
+func remapDanglingRunUsers(env *cleanupEnv, fallbackUserID string) error {
+	return forEachPlaybookRun(env.db, func(runs []*playbookRun) error {
+		var userIDs []string
+		for _, run := range runs {
+			runUserIDs, err := runUserIDs(run)
+			if err != nil {
+				return err
+			}
+			userIDs = append(userIDs, runUserIDs...)
+		}
+
+		existing, err := getExistingUserIDs(env.db, userIDs)
+		if err != nil {
+			return err
+		}
+
+		for _, run := range runs {
+			changes, err := remapRunUsers(run, func(userID string) bool { return !existing[userID] }, fallbackUserID)
+			if err != nil {
+				return err
+			}
+			if len(changes) == 0 {
+				continue
+			}
+
+			queryString, args, err := sq.Update("ir_incident").
+				Set("commanderuserid", run.OwnerUserID).
+				Set("reporteruserid", run.ReporterUserID).
+				Set("checklistsjson", run.Checklists).
+				Where(sq.Eq{"id": run.ID}).
+				PlaceholderFormat(env.db.placeholder()).
+				ToSql()
+			if err != nil {
+				return fmt.Errorf("error when trying to build the playbook run update query: %s", err.Error())
+			}
+			if _, err := env.db.Exec(queryString, args...); err != nil {
+				return fmt.Errorf("error when trying to update playbook run %s: %s", run.ID, err.Error())
+			}
+
+			if env.deletionJob != nil {
+				env.deletionJob.PlaybookRunChanges = append(env.deletionJob.PlaybookRunChanges, changes...)
+			}
+		}
+		return nil
+	})
+}
+
+// runUserIDs returns every user referenced by the run.
+func runUserIDs(run *playbookRun) ([]string, error) {
+	var userIDs []string
+	_, err := remapRunUsers(run, func(userID string) bool {
+		userIDs = append(userIDs, userID)
+		return false
+	}, "")
+	return userIDs, err
+}
+
+// remapRunUsers replaces every user of the run for which isGone returns
+// true, updating the run in place, and returns the changes made.
+func remapRunUsers(run *playbookRun, isGone func(string) bool, replacementUserID string) ([]playbookRunChange, error) {
+	var changes []playbookRunChange
+	remap := func(field string, userID *string) {
+		if *userID == "" || !isGone(*userID) {
+			return
+		}
+		changes = append(changes, playbookRunChange{
+			RunID:     run.ID,
+			RunName:   run.Name,
+			Field:     field,
+			UserID:    *userID,
+			NewUserID: replacementUserID,
+		})
+		*userID = replacementUserID
+	}
+
+	remap("owner", &run.OwnerUserID)
+	remap("reporter", &run.ReporterUserID)
+
+	if run.Checklists == "" {
+		return changes, nil
+	}
+
+	// Decode the checklists generically so that fields this plugin doesn't
+	// know about are written back unchanged.
+	var checklists []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(run.Checklists)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&checklists); err != nil {
+		return nil, fmt.Errorf("error parsing checklists of playbook run %s: %s", run.ID, err.Error())
+	}
+
+	checklistChanges := len(changes)
+	for _, checklist := range checklists {
+		items, _ := checklist["items"].([]interface{})
+		for _, item := range items {
+			fields, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			assigneeID, ok := fields["assignee_id"].(string)
+			if !ok {
+				continue
+			}
+			title, _ := fields["title"].(string)
+			remap(fmt.Sprintf("assignee of checklist item %q", title), &assigneeID)
+			fields["assignee_id"] = assigneeID
+		}
+	}
+
+	if len(changes) > checklistChanges {
+		checklistsJSON, err := json.Marshal(checklists)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding checklists of playbook run %s: %s", run.ID, err.Error())
+		}
+		run.Checklists = string(checklistsJSON)
+	}
+	return changes, nil
+}
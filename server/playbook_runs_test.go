@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_remapRunUsers(t *testing.T) {
+	const checklists = `[{"title":"Triage","items":[{"title":"Page on-call","assignee_id":"deleted1","state":""},{"title":"Update status","assignee_id":"kept1","state":"closed"},{"title":"Write summary","assignee_id":"","state":""}]}]`
+
+	tests := []struct {
+		description        string
+		run                playbookRun
+		replacementUserID  string
+		expectedOwner      string
+		expectedReporter   string
+		expectedChecklists string
+		expectedFields     []string
+	}{{
+		description:        "no deleted users should not change the run",
+		run:                playbookRun{OwnerUserID: "kept1", ReporterUserID: "kept2", Checklists: `[{"title":"Triage","items":[{"title":"Page on-call","assignee_id":"kept1"}]}]`},
+		expectedOwner:      "kept1",
+		expectedReporter:   "kept2",
+		expectedChecklists: `[{"title":"Triage","items":[{"title":"Page on-call","assignee_id":"kept1"}]}]`,
+	}, {
+		description:        "deleted users should be replaced",
+		run:                playbookRun{OwnerUserID: "deleted1", ReporterUserID: "deleted2", Checklists: checklists},
+		replacementUserID:  "fallback",
+		expectedOwner:      "fallback",
+		expectedReporter:   "fallback",
+		expectedChecklists: `[{"items":[{"assignee_id":"fallback","state":"","title":"Page on-call"},{"assignee_id":"kept1","state":"closed","title":"Update status"},{"assignee_id":"","state":"","title":"Write summary"}],"title":"Triage"}]`,
+		expectedFields:     []string{"owner", "reporter", `assignee of checklist item "Page on-call"`},
+	}, {
+		description:        "deleted users should be unassigned without a replacement",
+		run:                playbookRun{OwnerUserID: "kept1", ReporterUserID: "deleted2", Checklists: checklists},
+		expectedOwner:      "kept1",
+		expectedReporter:   "",
+		expectedChecklists: `[{"items":[{"assignee_id":"","state":"","title":"Page on-call"},{"assignee_id":"kept1","state":"closed","title":"Update status"},{"assignee_id":"","state":"","title":"Write summary"}],"title":"Triage"}]`,
+		expectedFields:     []string{"reporter", `assignee of checklist item "Page on-call"`},
+	}}
+
+	isGone := func(userID string) bool {
+		return userID == "deleted1" || userID == "deleted2"
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			run := test.run
+			changes, err := remapRunUsers(&run, isGone, test.replacementUserID)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if run.OwnerUserID != test.expectedOwner {
+				t.Errorf("expected owner: '%s', got: '%s'", test.expectedOwner, run.OwnerUserID)
+			}
+			if run.ReporterUserID != test.expectedReporter {
+				t.Errorf("expected reporter: '%s', got: '%s'", test.expectedReporter, run.ReporterUserID)
+			}
+			if run.Checklists != test.expectedChecklists {
+				t.Errorf("expected checklists: '%s', got: '%s'", test.expectedChecklists, run.Checklists)
+			}
+			if len(changes) != len(test.expectedFields) {
+				t.Fatalf("expected %d changes, got: %d", len(test.expectedFields), len(changes))
+			}
+			for i, change := range changes {
+				if change.Field != test.expectedFields[i] {
+					t.Errorf("expected change %d field: '%s', got: '%s'", i, test.expectedFields[i], change.Field)
+				}
+				if change.NewUserID != test.replacementUserID {
+					t.Errorf("expected change %d replacement: '%s', got: '%s'", i, test.replacementUserID, change.NewUserID)
+				}
+			}
+		})
+	}
+}
+
+func Test_remapRunUsers_invalidChecklists(t *testing.T) {
+	run := playbookRun{ID: "run1", Checklists: "not json"}
+	if _, err := remapRunUsers(&run, func(string) bool { return true }, ""); err == nil {
+		t.Error("expected an error for invalid checklists")
+	}
+}
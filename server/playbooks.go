@@ -7,7 +7,135 @@ import (
 	sq "github.com/Masterminds/squirrel"
 )
 
-func purgeCategoriesWithMissingUsers(db *sql.DB) (err error) {
+var playbooksIntegration = integration{
+	PluginID: "playbooks",
+	Tables: []string{
+		"ir_playbook",
+		"ir_playbookmember",
+		"ir_playbookautofollow",
+		"ir_metricconfig",
+		"ir_incident",
+		"ir_metric",
+		"ir_statusposts",
+		"ir_timelineevent",
+		"ir_run_participants",
+		"ir_category",
+		"ir_category_item",
+		"ir_viewedchannel",
+		"ir_userinfo",
+		"ir_channelaction",
+	},
+}
+
+// playbooksStage removes deleted users from playbooks and runs, then deletes
+// the playbooks that no longer have any members along with their runs.
+type playbooksStage struct{}
+
+func (playbooksStage) Name() string {
+	return "playbooks"
+}
+
+func (playbooksStage) IsApplicable(env *cleanupEnv) (bool, string) {
+	return detectIntegration(env, playbooksIntegration)
+}
+
+func (playbooksStage) DryRunLabel() string {
+	return "playbooks would be left without members and deleted, along with their runs"
+}
+
+func (playbooksStage) DryRunCount(env *cleanupEnv) (int, error) {
+	return countPlaybooksEmptiedByUsers(env.db, env.userIDs)
+}
+
+func (playbooksStage) Prepare(*cleanupEnv) error {
+	return nil
+}
+
+func (playbooksStage) Purge(env *cleanupEnv) error {
+	// Delete playbook members that no longer exist in the user table
+	if err := purgeDanglingPlaybookMembers(env.db); err != nil {
+		return fmt.Errorf("error removing users from playbook members list: %s", err.Error())
+	}
+
+	// Delete playbook runs with no members
+	if err := purgeRunsForEmptyPlaybooks(env.db); err != nil {
+		return fmt.Errorf("error removing empty playbook runs: %s", err.Error())
+	}
+
+	// Delete playbooks with no members
+	if err := purgeEmptyPlaybooks(env.db); err != nil {
+		return fmt.Errorf("error removing empty playbooks: %s", err.Error())
+	}
+
+	// Delete miscellaneous data related to deleted playbooks
+	if err := purgeDanglingPlaybookData(env.db); err != nil {
+		return fmt.Errorf("error removing dangling playbook data: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (playbooksStage) Verify(env *cleanupEnv) ([]userReference, error) {
+	return verifyTableColumns(env, []tableColumn{
+		{"ir_playbookmember", "memberid"},
+		{"ir_playbookautofollow", "userid"},
+		{"ir_run_participants", "userid"},
+		{"ir_category", "userid"},
+		{"ir_viewedchannel", "userid"},
+		{"ir_userinfo", "id"},
+	})
+}
+
+// playbookMemberships are the members of a playbook.
+var playbookMemberships = []membership{
+	{Table: "ir_playbookmember", ContainerColumn: "playbookid", UserColumn: "memberid"},
+}
+
+// countPlaybooksEmptiedByUsers counts the playbooks that would have no members
+// left once the given users are deleted, including playbooks already without
+// members.
+func countPlaybooksEmptiedByUsers(db *database, userIDs []string) (int, error) {
+	remainingMembersQuery := sq.Select("1").
+		From("ir_playbookmember").
+		Where("ir_playbookmember.playbookid = ir_playbook.id").
+		Where("EXISTS (SELECT 1 FROM Users WHERE Users.id = ir_playbookmember.memberid)")
+
+	remainingMembersQueryString, remainingMembersArgs, err := remainingMembersQuery.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to build the remaining playbook members query: %s", err.Error())
+	}
+
+	countQuery := sq.Select("COUNT(*)").
+		From("ir_playbook").
+		Where(sq.Expr("NOT EXISTS ("+remainingMembersQueryString+")", remainingMembersArgs...)).
+		PlaceholderFormat(db.placeholder())
+
+	countQueryString, countArgs, err := countQuery.ToSql()
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to build the empty playbooks count query: %s", err.Error())
+	}
+
+	var count int
+	if err := db.QueryRow(countQueryString, countArgs...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error when trying to count playbooks without members: %s", err.Error())
+	}
+
+	// Playbooks whose members are all among the users are emptied by
+	// deleting them. Playbooks without existing members are already counted
+	// above.
+	left, err := findContainersLeftByUsers(db, playbookMemberships, userIDs)
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to count playbooks emptied by users: %s", err.Error())
+	}
+	for _, members := range left {
+		if members > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func purgeCategoriesWithMissingUsers(db *database) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
@@ -43,7 +171,7 @@ func purgeCategoriesWithMissingUsers(db *sql.DB) (err error) {
 
 	categoryItemDeleteQuery := sq.Delete("ir_category_item").
 		Where(sq.Eq{"categoryid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	categoryItemDeleteQueryString, categoryItemDeleteQueryArgs, err := categoryItemDeleteQuery.ToSql()
 	if err != nil {
@@ -57,7 +185,7 @@ func purgeCategoriesWithMissingUsers(db *sql.DB) (err error) {
 
 	categoryDeleteQuery := sq.Delete("ir_category").
 		Where(sq.Eq{"id": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	categoryDeleteQueryString, categoryDeleteQueryArgs, err := categoryDeleteQuery.ToSql()
 	if err != nil {
@@ -76,7 +204,7 @@ func purgeCategoriesWithMissingUsers(db *sql.DB) (err error) {
 	return nil
 }
 
-func purgeDanglingPlaybookMembers(db *sql.DB) error {
+func purgeDanglingPlaybookMembers(db *database) error {
 	if err := purgeCategoriesWithMissingUsers(db); err != nil {
 		return err
 	}
@@ -139,7 +267,7 @@ func purgeDanglingPlaybookMembers(db *sql.DB) error {
 	return nil
 }
 
-func purgeEmptyPlaybooks(db *sql.DB) (err error) {
+func purgeEmptyPlaybooks(db *database) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
@@ -175,7 +303,7 @@ func purgeEmptyPlaybooks(db *sql.DB) (err error) {
 
 	metricConfigDeleteQuery := sq.Delete("ir_metricconfig").
 		Where(sq.Eq{"playbookid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	metricConfigDeleteQueryString, metricConfigDeleteQueryArgs, err := metricConfigDeleteQuery.ToSql()
 	if err != nil {
@@ -189,7 +317,7 @@ func purgeEmptyPlaybooks(db *sql.DB) (err error) {
 
 	autoFollowDeleteQuery := sq.Delete("ir_playbookautofollow").
 		Where(sq.Eq{"playbookid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	autoFollowDeleteQueryString, autoFollowDeleteQueryArgs, err := autoFollowDeleteQuery.ToSql()
 	if err != nil {
@@ -203,7 +331,7 @@ func purgeEmptyPlaybooks(db *sql.DB) (err error) {
 
 	playbookDeleteQuery := sq.Delete("ir_playbook").
 		Where(sq.Eq{"id": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	playbookDeleteQueryString, playbookDeleteQueryArgs, err := playbookDeleteQuery.ToSql()
 	if err != nil {
@@ -222,7 +350,7 @@ func purgeEmptyPlaybooks(db *sql.DB) (err error) {
 	return nil
 }
 
-func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
+func purgeRunsForEmptyPlaybooks(db *database) (err error) {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
@@ -259,7 +387,7 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 	incidentSelectQuery := sq.Select("id").
 		From("ir_incident").
 		Where(sq.Eq{"playbookid": playbookIDs}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	incidentSelectQueryString, incidentSelectQueryArgs, err := incidentSelectQuery.ToSql()
 	if err != nil {
@@ -280,9 +408,23 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 		ids = append(ids, id)
 	}
 
+	if err = deleteRuns(tx, db, ids); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
+	}
+
+	return nil
+}
+
+// deleteRuns deletes the given playbook runs along with their metrics, status
+// posts, timeline events and participants.
+func deleteRuns(tx *sql.Tx, db *database, ids []string) error {
 	metricDeleteQuery := sq.Delete("ir_metric").
 		Where(sq.Eq{"incidentid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	metricDeleteQueryString, metricDeleteQueryArgs, err := metricDeleteQuery.ToSql()
 	if err != nil {
@@ -296,7 +438,7 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 
 	statusPostsDeleteQuery := sq.Delete("ir_statusposts").
 		Where(sq.Eq{"incidentid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	statusPostsDeleteQueryString, statusPostsDeleteQueryArgs, err := statusPostsDeleteQuery.ToSql()
 	if err != nil {
@@ -310,7 +452,7 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 
 	timelineEventDeleteQuery := sq.Delete("ir_timelineevent").
 		Where(sq.Eq{"incidentid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	timelineEventDeleteQueryString, timelineEventDeleteQueryArgs, err := timelineEventDeleteQuery.ToSql()
 	if err != nil {
@@ -324,7 +466,7 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 
 	runParticipantsDeleteQuery := sq.Delete("ir_run_participants").
 		Where(sq.Eq{"incidentid": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	runParticipantsDeleteQueryString, runParticipantsDeleteQueryArgs, err := runParticipantsDeleteQuery.ToSql()
 	if err != nil {
@@ -338,7 +480,7 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 
 	runDeleteQuery := sq.Delete("ir_incident").
 		Where(sq.Eq{"id": ids}).
-		PlaceholderFormat(sq.Dollar)
+		PlaceholderFormat(db.placeholder())
 
 	runDeleteQueryString, runDeleteQueryArgs, err := runDeleteQuery.ToSql()
 	if err != nil {
@@ -350,14 +492,10 @@ func purgeRunsForEmptyPlaybooks(db *sql.DB) (err error) {
 		return fmt.Errorf("error when trying to delete playbook runs: %s", err.Error())
 	}
 
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
-	}
-
 	return nil
 }
 
-func purgeDanglingPlaybookData(db *sql.DB) error {
+func purgeDanglingPlaybookData(db *database) error {
 	if _, err := db.Exec(`
 			DELETE FROM ir_channelaction
 			  WHERE NOT EXISTS (
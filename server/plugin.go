@@ -6,8 +6,10 @@ import (
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 )
 
+const PluginID = "com.mattermost.plugin-bulk-user-delete"
 const SocketClientPath = "/var/tmp/mattermost_local.socket"
 const RunningKey = "com.mattermost.plugin-bulk-user-delete/running"
 
@@ -18,12 +20,20 @@ type Plugin struct {
 	pluginClient *pluginapi.Client
 	socketClient *model.Client4
 
+	// botUserID is the bot that sends deletion notices, posts deletion
+	// requests and runs scheduled jobs.
+	botUserID string
+
 	// configurationLock synchronizes access to the configuration.
 	configurationLock sync.RWMutex
 
 	// configuration is the active plugin configuration. Consult getConfiguration and
 	// setConfiguration for usage.
 	configuration *configuration
+
+	// stagedDeletionJob periodically deletes staged users whose grace
+	// period has passed, and processes deletion requests.
+	stagedDeletionJob *cluster.Job
 }
 
 // OnActivate is invoked when the plugin is activated.
@@ -33,9 +43,45 @@ func (p *Plugin) OnActivate() error {
 	p.socketClient = model.NewAPIv4SocketClient(SocketClientPath)
 	p.pluginClient = pluginapi.NewClient(p.API, p.Driver)
 
+	// A job can't survive a restart, so a running key left set by one is
+	// stale.
 	if _, err := p.pluginClient.KV.Set(RunningKey, false); err != nil {
 		return err
 	}
 
+	botUserID, err := p.pluginClient.Bot.EnsureBot(&model.Bot{
+		Username:    BotUsername,
+		DisplayName: BotDisplayName,
+		Description: "Notifies users before their accounts are deleted and posts deletion requests and scheduled job reports.",
+	})
+	if err != nil {
+		return err
+	}
+	p.botUserID = botUserID
+
+	stagedDeletionJob, err := cluster.Schedule(p.API, StagedDeletionJobKey,
+		cluster.MakeWaitForRoundedInterval(stagedDeletionInterval), p.runScheduledTasks)
+	if err != nil {
+		return err
+	}
+	p.stagedDeletionJob = stagedDeletionJob
+
 	return registerSlashCommand(p.pluginClient)
 }
+
+// runScheduledTasks runs the periodic deletions, on one server of the
+// cluster at a time.
+func (p *Plugin) runScheduledTasks() {
+	p.runStagedDeletions()
+	p.processDeletionRequests()
+	p.runScheduledLDAPDeletion()
+	p.runScheduledGuestCleanup()
+}
+
+// OnDeactivate is invoked when the plugin is deactivated.
+func (p *Plugin) OnDeactivate() error {
+	if p.stagedDeletionJob != nil {
+		return p.stagedDeletionJob.Close()
+	}
+	return nil
+}
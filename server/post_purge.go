@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// purgeUserIDsTable and purgePostIDsTable are the temporary tables the
+	// set-based post purge stages its IDs in.
+	purgeUserIDsTable = "bulk_delete_user_ids"
+	purgePostIDsTable = "bulk_delete_post_ids"
+
+	defaultPostPurgeBatchSize = 1000
+	defaultPostPurgeRowLimit  = 5000
+)
+
+// postPurgeBatchSize returns how many deleted users have their posts purged
+// together by the set-based post purge.
+func (c *configuration) postPurgeBatchSize() int {
+	if c.PostPurgeBatchSize < 1 {
+		return defaultPostPurgeBatchSize
+	}
+	return c.PostPurgeBatchSize
+}
+
+// postPurgeRowLimit returns how many posts each statement of the set-based
+// post purge deletes at most. The thread memberships and reactions of those
+// posts are deleted along with them.
+func (c *configuration) postPurgeRowLimit() int {
+	if c.PostPurgeRowLimit < 1 {
+		return defaultPostPurgeRowLimit
+	}
+	return c.PostPurgeRowLimit
+}
+
+// createTempIDTableQuery returns the statement creating a temporary table
+// with a single id column.
+func createTempIDTableQuery(table string) string {
+	return fmt.Sprintf("CREATE TEMPORARY TABLE %s (id VARCHAR(26) NOT NULL PRIMARY KEY)", table)
+}
+
+// dropTempTableQuery returns the statement dropping a temporary table.
+func dropTempTableQuery(mysql bool, table string) string {
+	if mysql {
+		return fmt.Sprintf("DROP TEMPORARY TABLE IF EXISTS %s", table)
+	}
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s", table)
+}
+
+// joinedDeleteQuery returns a statement deleting the rows of table whose
+// column matches an id in idTable.
+func joinedDeleteQuery(mysql bool, table, column, idTable string) string {
+	if mysql {
+		return fmt.Sprintf("DELETE %[1]s FROM %[1]s INNER JOIN %[3]s ON %[1]s.%[2]s = %[3]s.id", table, column, idTable)
+	}
+	return fmt.Sprintf("DELETE FROM %[1]s USING %[3]s WHERE %[1]s.%[2]s = %[3]s.id", table, column, idTable)
+}
+
+// purgeDanglingPosts is the set-based alternative to purgeDanglingUserPosts.
+// It stages the given user IDs in a temporary table, then deletes the replies
+// to their posts and then their posts, with the threads, thread memberships
+// and reactions of each, up to rowLimit posts per transaction. Users that
+// still exist are dropped from the staged IDs first, so only posts of deleted
+// users are purged.
+func purgeDanglingPosts(db *database, userIDs []string, rowLimit int) (err error) {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	// Temporary tables only exist on the connection that created them, so
+	// every statement runs on the same connection.
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("error when trying to get a database connection: %s", err.Error())
+	}
+	defer conn.Close()
+
+	for _, table := range []string{purgeUserIDsTable, purgePostIDsTable} {
+		// A table left behind on a pooled connection is dropped first so
+		// no stale IDs are purged.
+		if _, err = conn.ExecContext(ctx, dropTempTableQuery(db.isMySQL(), table)); err != nil {
+			return fmt.Errorf("error when trying to drop temporary table %s: %s", table, err.Error())
+		}
+		if _, err = conn.ExecContext(ctx, createTempIDTableQuery(table)); err != nil {
+			return fmt.Errorf("error when trying to create temporary table %s: %s", table, err.Error())
+		}
+		defer func(table string) {
+			if _, dropErr := conn.ExecContext(ctx, dropTempTableQuery(db.isMySQL(), table)); dropErr != nil && err == nil {
+				err = fmt.Errorf("error when trying to drop temporary table %s: %s", table, dropErr.Error())
+			}
+		}(table)
+	}
+
+	if err = stageDeletedUserIDs(ctx, db, conn, userIDs); err != nil {
+		return err
+	}
+
+	// Replies are purged first, so a long thread is deleted a page at a
+	// time rather than along with its root post.
+	stageQueries := []struct {
+		query, description string
+	}{
+		{stageRepliesQuery(rowLimit), "replies to user posts"},
+		{stageUserPostsQuery(rowLimit), "user posts"},
+	}
+	for _, stage := range stageQueries {
+		for {
+			count, err := purgeStagedPostsPage(ctx, db, conn, stage.query, stage.description)
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// stageRepliesQuery returns the statement staging up to rowLimit replies to
+// posts of the staged users.
+func stageRepliesQuery(rowLimit int) string {
+	return fmt.Sprintf(
+		"INSERT INTO %[1]s (id) SELECT Replies.Id FROM Posts AS Replies INNER JOIN Posts AS Roots ON Replies.RootId = Roots.Id INNER JOIN %[2]s ON Roots.UserId = %[2]s.id LIMIT %[3]d",
+		purgePostIDsTable, purgeUserIDsTable, rowLimit)
+}
+
+// stageUserPostsQuery returns the statement staging up to rowLimit posts of
+// the staged users.
+func stageUserPostsQuery(rowLimit int) string {
+	return fmt.Sprintf(
+		"INSERT INTO %[1]s (id) SELECT Posts.Id FROM Posts INNER JOIN %[2]s ON Posts.UserId = %[2]s.id LIMIT %[3]d",
+		purgePostIDsTable, purgeUserIDsTable, rowLimit)
+}
+
+// stageDeletedUserIDs inserts the user IDs into the staged user table and
+// removes the users that still exist.
+func stageDeletedUserIDs(ctx context.Context, db *database, conn *sql.Conn, userIDs []string) error {
+	for start := 0; start < len(userIDs); start += selectionPageSize {
+		end := start + selectionPageSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		insert := sq.Insert(purgeUserIDsTable).Columns("id").PlaceholderFormat(db.placeholder())
+		for _, id := range userIDs[start:end] {
+			insert = insert.Values(id)
+		}
+		queryString, args, err := insert.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the query: %s", err.Error())
+		}
+		if _, err = conn.ExecContext(ctx, queryString, args...); err != nil {
+			return fmt.Errorf("error when trying to stage user IDs: %s", err.Error())
+		}
+	}
+
+	_, err := conn.ExecContext(ctx, joinedDeleteQuery(db.isMySQL(), purgeUserIDsTable, "id", "Users"))
+	if err != nil {
+		return fmt.Errorf("error when trying to unstage existing users: %s", err.Error())
+	}
+	return nil
+}
+
+// purgeStagedPostsPage stages a page of posts with stageQuery and deletes
+// them in one transaction. It returns the number of posts staged.
+func purgeStagedPostsPage(ctx context.Context, db *database, conn *sql.Conn, stageQuery, description string) (count int64, err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to begin transaction: %s", err.Error())
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
+				rollbackErr.Error(), err.Error())
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, stageQuery)
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to stage %s: %s", description, err.Error())
+	}
+	count, err = result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error when trying to count staged %s: %s", description, err.Error())
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	deletes := []struct {
+		table, column, description string
+	}{
+		{"Threads", "PostId", "threads"},
+		{"ThreadMemberships", "PostId", "thread memberships"},
+		{"Reactions", "PostId", "reactions"},
+		{"Posts", "Id", "posts"},
+	}
+	for _, d := range deletes {
+		if _, err = tx.ExecContext(ctx, joinedDeleteQuery(db.isMySQL(), d.table, d.column, purgePostIDsTable)); err != nil {
+			return 0, fmt.Errorf("error when trying to delete %s of %s: %s", d.description, description, err.Error())
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", purgePostIDsTable)); err != nil {
+		return 0, fmt.Errorf("error when trying to clear staged %s: %s", description, err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
+	}
+	return count, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_joinedDeleteQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		mysql    bool
+		table    string
+		column   string
+		expected string
+	}{
+		{
+			name:     "postgres should delete using the id table",
+			table:    "Reactions",
+			column:   "PostId",
+			expected: "DELETE FROM Reactions USING bulk_delete_post_ids WHERE Reactions.PostId = bulk_delete_post_ids.id",
+		},
+		{
+			name:     "mysql should delete with an inner join",
+			mysql:    true,
+			table:    "Reactions",
+			column:   "PostId",
+			expected: "DELETE Reactions FROM Reactions INNER JOIN bulk_delete_post_ids ON Reactions.PostId = bulk_delete_post_ids.id",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := joinedDeleteQuery(tt.mysql, tt.table, tt.column, purgePostIDsTable)
+			if got != tt.expected {
+				t.Errorf("expected: '%s', got: '%s'", tt.expected, got)
+			}
+		})
+	}
+}
+
+func Test_postPurgeSettings(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            configuration
+		expectedBatchSize int
+		expectedRowLimit  int
+	}{
+		{
+			name:              "unset settings should use the defaults",
+			expectedBatchSize: defaultPostPurgeBatchSize,
+			expectedRowLimit:  defaultPostPurgeRowLimit,
+		},
+		{
+			name:              "set settings should be used",
+			config:            configuration{PostPurgeBatchSize: 200, PostPurgeRowLimit: 500},
+			expectedBatchSize: 200,
+			expectedRowLimit:  500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.postPurgeBatchSize(); got != tt.expectedBatchSize {
+				t.Errorf("expected: '%d', got: '%d'", tt.expectedBatchSize, got)
+			}
+			if got := tt.config.postPurgeRowLimit(); got != tt.expectedRowLimit {
+				t.Errorf("expected: '%d', got: '%d'", tt.expectedRowLimit, got)
+			}
+		})
+	}
+}
+
+// Test_purgeDanglingPosts runs the set-based post purge against the empty
+// PostgreSQL database given by BULK_USER_DELETE_TEST_POSTGRES_DSN. The
+// tables it creates are dropped afterwards.
+func Test_purgeDanglingPosts(t *testing.T) {
+	const envVar = "BULK_USER_DELETE_TEST_POSTGRES_DSN"
+	dsn := os.Getenv(envVar)
+	if dsn == "" {
+		t.Skipf("%s is not set", envVar)
+	}
+	sqlDB, err := sql.Open(model.DatabaseDriverPostgres, dsn)
+	if err != nil {
+		t.Fatalf("expected: no error, got: '%s'", err.Error())
+	}
+	defer sqlDB.Close()
+	db := &database{DB: sqlDB, driverName: model.DatabaseDriverPostgres}
+
+	// The test creates Mattermost table names, so it refuses to run against a
+	// database that has any of them, and only drops the tables it created.
+	existingTables, err := getTableNames(db)
+	if err != nil {
+		t.Fatalf("expected: no error, got: '%s'", err.Error())
+	}
+	for _, table := range []string{"users", "posts", "threads", "threadmemberships", "reactions", "persistentnotifications"} {
+		if name, ok := existingTables[table]; ok {
+			t.Fatalf("%s already has a %s table: point it at an empty database", envVar, name)
+		}
+	}
+	var createdTables []string
+	defer func() {
+		for _, table := range createdTables {
+			if _, err := db.Exec("DROP TABLE " + table); err != nil {
+				t.Errorf("expected: no error, got: '%s'", err.Error())
+			}
+		}
+	}()
+
+	tables := []struct {
+		name       string
+		definition string
+	}{
+		{"Users", "Id VARCHAR(26) NOT NULL PRIMARY KEY"},
+		{"Posts", "Id VARCHAR(26) NOT NULL PRIMARY KEY, UserId VARCHAR(26), RootId VARCHAR(26)"},
+		{"Threads", "PostId VARCHAR(26) NOT NULL PRIMARY KEY"},
+		{"ThreadMemberships", "PostId VARCHAR(26) NOT NULL, UserId VARCHAR(26) NOT NULL, PRIMARY KEY (PostId, UserId)"},
+		{"Reactions", "PostId VARCHAR(26) NOT NULL, UserId VARCHAR(26) NOT NULL, PRIMARY KEY (PostId, UserId)"},
+		{"PersistentNotifications", "PostId VARCHAR(26) NOT NULL PRIMARY KEY"},
+	}
+	for _, table := range tables {
+		if _, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", table.name, table.definition)); err != nil {
+			t.Fatalf("expected: no error, got: '%s'", err.Error())
+		}
+		createdTables = append(createdTables, table.name)
+	}
+
+	statements := []string{
+		// live still exists, gone and other were deleted. other is not being
+		// purged.
+		"INSERT INTO Users (Id) VALUES ('live')",
+		"INSERT INTO Posts (Id, UserId, RootId) VALUES ('gone1', 'gone', ''), ('gone2', 'gone', ''), ('gonereply', 'gone', 'live1'), ('live1', 'live', ''), ('livereply1', 'live', 'gone1'), ('livereply2', 'live', 'gone1'), ('other1', 'other', '')",
+		"INSERT INTO Threads (PostId) VALUES ('gone1'), ('live1'), ('other1')",
+		"INSERT INTO ThreadMemberships (PostId, UserId) VALUES ('gone1', 'live'), ('live1', 'gone'), ('live1', 'live')",
+		"INSERT INTO Reactions (PostId, UserId) VALUES ('gone2', 'live'), ('livereply1', 'live'), ('live1', 'gone')",
+		"INSERT INTO PersistentNotifications (PostId) VALUES ('gone1'), ('live1')",
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("expected: no error, got: '%s'", err.Error())
+		}
+	}
+
+	// A row limit of 1 makes every post its own transaction.
+	if err := purgeDanglingPosts(db, []string{"gone", "live"}, 1); err != nil {
+		t.Fatalf("expected: no error, got: '%s'", err.Error())
+	}
+	if err := purgeOrphanedPersistentNotifications(db, map[string]string{"persistentnotifications": "PersistentNotifications"}); err != nil {
+		t.Fatalf("expected: no error, got: '%s'", err.Error())
+	}
+
+	expectedRows := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT Id FROM Posts", "live1,other1"},
+		{"SELECT PostId FROM Threads", "live1,other1"},
+		{"SELECT PostId FROM ThreadMemberships", "live1,live1"},
+		{"SELECT PostId FROM Reactions", "live1"},
+		{"SELECT PostId FROM PersistentNotifications", "live1"},
+	}
+	for _, e := range expectedRows {
+		got, err := queryColumn(db, e.query)
+		if err != nil {
+			t.Fatalf("expected: no error, got: '%s'", err.Error())
+		}
+		if got != e.expected {
+			t.Errorf("%s: expected: '%s', got: '%s'", e.query, e.expected, got)
+		}
+	}
+}
+
+// queryColumn returns the sorted values of the query's single column, joined
+// by commas.
+func queryColumn(db *database, query string) (string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ","), rows.Err()
+}
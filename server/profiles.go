@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+	"gopkg.in/yaml.v2"
+)
+
+const ProfileKeyPrefix = "com.mattermost.plugin-bulk-user-delete/profile/"
+
+// ProfileTargetPrefix selects a profile as the target users, as in
+// profile:contractors.
+const ProfileTargetPrefix = "profile:"
+
+const ProfileCreate = "create"
+const ProfileList = "list"
+const ProfileShow = "show"
+const ProfileDelete = "delete"
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// cleanupProfile is a named set of filters, protections and cleanup options
+// for a recurring cleanup. Profiles replace the email filter settings for the
+// jobs that run them.
+type cleanupProfile struct {
+	Name            string   `yaml:"-"`
+	Filter          string   `yaml:"filter,omitempty"`
+	EmailSuffixes   []string `yaml:"email_suffixes,omitempty"`
+	Emails          []string `yaml:"emails,omitempty"`
+	InactiveOnly    bool     `yaml:"inactive_only,omitempty"`
+	Protect         string   `yaml:"protect,omitempty"`
+	EnabledStages   []string `yaml:"enabled_stages,omitempty"`
+	DisabledStages  []string `yaml:"disabled_stages,omitempty"`
+	ReportChannelID string   `yaml:"report_channel_id,omitempty"`
+}
+
+// parseProfile parses a profile document, written either as YAML or JSON,
+// and checks that the profile is complete.
+func parseProfile(name string, document string) (*cleanupProfile, error) {
+	if !profileNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid profile name '%s'. Use lowercase letters, digits, '-' and '_'", name)
+	}
+
+	profile := &cleanupProfile{}
+	if err := yaml.UnmarshalStrict([]byte(document), profile); err != nil {
+		return nil, fmt.Errorf("unable to parse profile: %s", err.Error())
+	}
+	profile.Name = name
+
+	if profile.Filter == "" && len(profile.EmailSuffixes) == 0 && len(profile.Emails) == 0 {
+		return nil, fmt.Errorf("a profile needs a filter, email suffixes or emails")
+	}
+	if profile.Filter != "" {
+		if len(profile.EmailSuffixes) > 0 || len(profile.Emails) > 0 || profile.InactiveOnly {
+			return nil, fmt.Errorf("a profile's filter can't be combined with email suffixes, emails or inactive only")
+		}
+		if _, err := parseFilter(profile.Filter); err != nil {
+			return nil, fmt.Errorf("filter: %s", describeFilterError(profile.Filter, 0, err))
+		}
+	}
+	if profile.Protect != "" {
+		if _, err := parseFilter(profile.Protect); err != nil {
+			return nil, fmt.Errorf("protect: %s", describeFilterError(profile.Protect, 0, err))
+		}
+	}
+
+	stageNames := map[string]bool{}
+	for _, stage := range cleanupStages {
+		stageNames[stage.Name()] = true
+	}
+	enabled := map[string]bool{}
+	for _, name := range profile.EnabledStages {
+		if !stageNames[name] {
+			return nil, fmt.Errorf("unknown cleanup stage '%s'", name)
+		}
+		enabled[name] = true
+	}
+	for _, name := range profile.DisabledStages {
+		if !stageNames[name] {
+			return nil, fmt.Errorf("unknown cleanup stage '%s'", name)
+		}
+		if enabled[name] {
+			return nil, fmt.Errorf("cleanup stage '%s' can't be both enabled and disabled", name)
+		}
+	}
+
+	if profile.ReportChannelID != "" && !model.IsValidId(profile.ReportChannelID) {
+		return nil, fmt.Errorf("invalid report channel ID '%s'", profile.ReportChannelID)
+	}
+	return profile, nil
+}
+
+// withStages returns a copy of the configuration that runs the enabled
+// cleanup stages even if the plugin settings disable them, and disables the
+// disabled ones.
+func (c *configuration) withStages(enabled, disabled []string) *configuration {
+	clone := c.Clone()
+	if len(enabled) == 0 && len(disabled) == 0 {
+		return clone
+	}
+
+	isEnabled := map[string]bool{}
+	for _, name := range enabled {
+		isEnabled[name] = true
+	}
+	var names []string
+	for _, name := range c.DisabledCleanupStages() {
+		if !isEnabled[name] {
+			names = append(names, name)
+		}
+	}
+	clone.DisabledCleanupStagesCSV = strings.Join(append(names, disabled...), ",")
+	return clone
+}
+
+// excludeFilterMatches returns the users the filter doesn't match.
+func excludeFilterMatches(filter filterNode, users []*model.User, lookups *filterLookups) []*model.User {
+	var remaining []*model.User
+	for _, user := range users {
+		if !filter.matches(user, lookups) {
+			remaining = append(remaining, user)
+		}
+	}
+	return remaining
+}
+
+// selectProfileUsers returns the IDs of the users matching a profile's
+// filters, except the users its protections match.
+func (p *Plugin) selectProfileUsers(profile *cleanupProfile) ([]string, error) {
+	query := emailQuery(profile.InactiveOnly, profile.EmailSuffixes, profile.Emails)
+	var pageFilters []userPageFilter
+	if profile.Filter != "" {
+		filter, err := parseFilter(profile.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("%s", describeFilterError(profile.Filter, 0, err))
+		}
+		keep, err := p.newFilterPageFilter(filter, false)
+		if err != nil {
+			return nil, err
+		}
+		query = pushDownFilter(filter)
+		pageFilters = append(pageFilters, keep)
+	}
+	if profile.Protect != "" {
+		protect, err := parseFilter(profile.Protect)
+		if err != nil {
+			return nil, fmt.Errorf("%s", describeFilterError(profile.Protect, 0, err))
+		}
+		exclude, err := p.newFilterPageFilter(protect, true)
+		if err != nil {
+			return nil, err
+		}
+		pageFilters = append(pageFilters, exclude)
+	}
+
+	if len(pageFilters) == 0 {
+		return p.selectUserIDs(query, nil)
+	}
+	return p.selectUserIDs(query, func(users []*model.User) ([]*model.User, error) {
+		var err error
+		for _, pageFilter := range pageFilters {
+			if users, err = pageFilter(users); err != nil {
+				return nil, err
+			}
+		}
+		return users, nil
+	})
+}
+
+func (p *Plugin) executeProfileCommand(args *model.CommandArgs, fields []string) *model.CommandResponse {
+	switch fields[2] {
+	case ProfileCreate:
+		document, _ := commandRemainder(args.Command, 4)
+		return p.executeCreateProfileCommand(fields[3], document)
+	case ProfileList:
+		return p.executeListProfilesCommand()
+	case ProfileShow:
+		return p.executeShowProfileCommand(fields[3])
+	default:
+		return p.executeDeleteProfileCommand(fields[3])
+	}
+}
+
+func (p *Plugin) executeCreateProfileCommand(name string, document string) *model.CommandResponse {
+	profile, err := parseProfile(name, document)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Invalid profile: %s", err.Error()),
+		}
+	}
+	if profile.ReportChannelID != "" {
+		if _, err = p.pluginClient.Channel.Get(profile.ReportChannelID); err != nil {
+			return &model.CommandResponse{
+				ResponseType: model.CommandResponseTypeEphemeral,
+				Text:         fmt.Sprintf("Unable to find report channel `%s`: %s", profile.ReportChannelID, err.Error()),
+			}
+		}
+	}
+
+	set, err := p.pluginClient.KV.Set(ProfileKeyPrefix+name, profile, pluginapi.SetAtomic(nil))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to save profile: %s", err.Error()),
+		}
+	}
+	if !set {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Profile `%s` already exists. Delete it first to replace it.", name),
+		}
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Created profile `%s`. Run `/%s %s %s%s` to use it.", name, Trigger, ModeDryRun, ProfileTargetPrefix, name),
+	}
+}
+
+func (p *Plugin) executeListProfilesCommand() *model.CommandResponse {
+	profiles, err := getProfiles(p.pluginClient)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to retrieve profiles: %s", err.Error()),
+		}
+	}
+	if len(profiles) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("There are no profiles. Run `/%s %s %s [name] [document]` to create one.", Trigger, ModeProfile, ProfileCreate),
+		}
+	}
+
+	var list strings.Builder
+	list.WriteString("Profiles:")
+	for _, profile := range profiles {
+		fmt.Fprintf(&list, "\n- `%s`: %s", profile.Name, profile.describeFilters())
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         list.String(),
+	}
+}
+
+func (p *Plugin) executeShowProfileCommand(name string) *model.CommandResponse {
+	profile, err := getProfile(p.pluginClient, name)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to retrieve profile: %s", err.Error()),
+		}
+	}
+	if profile == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("No profile found named `%s`", name),
+		}
+	}
+
+	document, err := yaml.Marshal(profile)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to format profile: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Profile `%s`:\n```yaml\n%s```", name, document),
+	}
+}
+
+func (p *Plugin) executeDeleteProfileCommand(name string) *model.CommandResponse {
+	profile, err := getProfile(p.pluginClient, name)
+	if err == nil && profile == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("No profile found named `%s`", name),
+		}
+	}
+	if err == nil {
+		err = p.pluginClient.KV.Delete(ProfileKeyPrefix + name)
+	}
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to delete profile: %s", err.Error()),
+		}
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Deleted profile `%s`", name),
+	}
+}
+
+// describeFilters summarizes which users the profile targets.
+func (p *cleanupProfile) describeFilters() string {
+	var description string
+	if p.Filter != "" {
+		description = fmt.Sprintf("filter `%s`", p.Filter)
+	} else {
+		description = fmt.Sprintf("%d email suffixes and %d emails", len(p.EmailSuffixes), len(p.Emails))
+		if p.InactiveOnly {
+			description += ", inactive users only"
+		}
+	}
+	if p.Protect != "" {
+		description += fmt.Sprintf(", protecting `%s`", p.Protect)
+	}
+	return description
+}
+
+// getProfile returns the profile with the given name, or nil if there is no
+// such profile.
+func getProfile(client *pluginapi.Client, name string) (*cleanupProfile, error) {
+	var profile *cleanupProfile
+	if err := client.KV.Get(ProfileKeyPrefix+name, &profile); err != nil {
+		return nil, fmt.Errorf("could not get profile %s: %s", name, err.Error())
+	}
+	if profile != nil {
+		profile.Name = name
+	}
+	return profile, nil
+}
+
+func getProfiles(client *pluginapi.Client) ([]*cleanupProfile, error) {
+	keys, err := listKeysWithPrefix(client, ProfileKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []*cleanupProfile
+	for _, key := range keys {
+		profile, err := getProfile(client, strings.TrimPrefix(key, ProfileKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		if profile != nil {
+			profiles = append(profiles, profile)
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_parseProfile(t *testing.T) {
+	tests := []struct {
+		description string
+		name        string
+		document    string
+		expectErr   bool
+	}{{
+		description: "json profile with email filters",
+		name:        "contractors",
+		document:    `{"email_suffixes": ["@contractor.example.com"], "inactive_only": true, "disabled_stages": ["boards"]}`,
+	}, {
+		description: "profile enabling and disabling stages",
+		name:        "stages",
+		document:    `{"emails": ["test@example.com"], "enabled_stages": ["playbook-runs"], "disabled_stages": ["boards"]}`,
+	}, {
+		description: "yaml profile with a filter and protections",
+		name:        "test-accounts",
+		document: `
+filter: email~"^test-"
+protect: team:core
+report_channel_id: 4xp9fdt77pncbef59f4k1qe83o
+`,
+	}, {
+		description: "invalid name",
+		name:        "Test Accounts",
+		document:    `{"emails": ["test@example.com"]}`,
+		expectErr:   true,
+	}, {
+		description: "profile without filters",
+		name:        "empty",
+		document:    `{"inactive_only": true}`,
+		expectErr:   true,
+	}, {
+		description: "filter combined with email filters",
+		name:        "mixed",
+		document:    `{"filter": "auth=saml", "emails": ["test@example.com"]}`,
+		expectErr:   true,
+	}, {
+		description: "invalid filter",
+		name:        "broken",
+		document:    `{"filter": "auth=saml AND"}`,
+		expectErr:   true,
+	}, {
+		description: "invalid protections",
+		name:        "broken",
+		document:    `{"emails": ["test@example.com"], "protect": "NOT"}`,
+		expectErr:   true,
+	}, {
+		description: "unknown cleanup stage",
+		name:        "stages",
+		document:    `{"emails": ["test@example.com"], "disabled_stages": ["calls"]}`,
+		expectErr:   true,
+	}, {
+		description: "unknown enabled cleanup stage",
+		name:        "stages",
+		document:    `{"emails": ["test@example.com"], "enabled_stages": ["calls"]}`,
+		expectErr:   true,
+	}, {
+		description: "stage both enabled and disabled",
+		name:        "stages",
+		document:    `{"emails": ["test@example.com"], "enabled_stages": ["boards"], "disabled_stages": ["boards"]}`,
+		expectErr:   true,
+	}, {
+		description: "invalid report channel",
+		name:        "report",
+		document:    `{"emails": ["test@example.com"], "report_channel_id": "town-square"}`,
+		expectErr:   true,
+	}, {
+		description: "unknown field",
+		name:        "unknown",
+		document:    `{"emails": ["test@example.com"], "email": "test@example.com"}`,
+		expectErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			profile, err := parseProfile(test.name, test.document)
+			if test.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if profile.Name != test.name {
+				t.Errorf("expected: '%s', got: '%s'", test.name, profile.Name)
+			}
+		})
+	}
+}
+
+func Test_withStages(t *testing.T) {
+	tests := []struct {
+		description string
+		enabled     []string
+		disabled    []string
+		expected    string
+	}{{
+		description: "no stages should keep the settings",
+		expected:    "playbooks,playbook-runs",
+	}, {
+		description: "disabled stages should be added",
+		disabled:    []string{"boards"},
+		expected:    "playbooks,playbook-runs,boards",
+	}, {
+		description: "enabled stages should be removed",
+		enabled:     []string{"playbooks"},
+		disabled:    []string{"boards"},
+		expected:    "playbook-runs,boards",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := &configuration{DisabledCleanupStagesCSV: "playbooks,playbook-runs"}
+			got := config.withStages(test.enabled, test.disabled).DisabledCleanupStagesCSV
+			if got != test.expected {
+				t.Errorf("expected: '%s', got: '%s'", test.expected, got)
+			}
+			if config.DisabledCleanupStagesCSV != "playbooks,playbook-runs" {
+				t.Errorf("expected: '%s', got: '%s'", "playbooks,playbook-runs", config.DisabledCleanupStagesCSV)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+const DeletionRequestKeyPrefix = "com.mattermost.plugin-bulk-user-delete/request/"
+
+// minDeletionRequestWait is the shortest time requests wait before they're
+// approved automatically, so users always have a chance to cancel them.
+const minDeletionRequestWait = 24 * time.Hour
+
+// deletionRequest is a user's own request to have their account deleted,
+// queued until an admin approves it or it is processed automatically.
+type deletionRequest struct {
+	UserID      string
+	RequestedAt int64
+}
+
+func (p *Plugin) executeRequestDeletionCommand(args *model.CommandArgs, confirmed bool) *model.CommandResponse {
+	user, err := p.pluginClient.User.Get(args.UserId)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not retrieve your account: %s", err.Error()),
+		}
+	}
+	if user.IsInRole(model.SystemAdminRoleId) {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "System administrators can't be deleted by this plugin.",
+		}
+	}
+
+	if !confirmed {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text: fmt.Sprintf("This will permanently delete your account and all of your messages and files. It can't be undone.\nRun `/%s %s %s` to confirm.",
+				Trigger, ModeRequestDeletion, RequestConfirm),
+		}
+	}
+
+	set, err := p.pluginClient.KV.Set(DeletionRequestKeyPrefix+user.Id, deletionRequest{
+		UserID:      user.Id,
+		RequestedAt: model.GetMillis(),
+	}, pluginapi.SetAtomic(nil))
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not queue your deletion request: %s", err.Error()),
+		}
+	}
+	if !set {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "Your account is already queued for deletion.",
+		}
+	}
+
+	p.pluginClient.Log.Info("User requested deletion of their account", "user_id", user.Id)
+	if channelID := p.getConfiguration().DeletionRequestsChannelID; channelID != "" {
+		if err = p.pluginClient.Post.CreatePost(&model.Post{
+			UserId:    p.botUserID,
+			ChannelId: channelID,
+			Message: fmt.Sprintf("@%s requested deletion of their account. Run `/%s %s %s` to approve it.",
+				user.Username, Trigger, ModeApproveRequests, user.Id),
+		}); err != nil {
+			p.pluginClient.Log.Error("Unable to post deletion request", "error", err)
+		}
+	}
+
+	text := "Your account is queued for deletion. It will be deleted once the request is approved by an administrator."
+	if config := p.getConfiguration(); config.ApproveDeletionRequestsAutomatically {
+		text = fmt.Sprintf("Your account is queued for deletion. It will be deleted after %s.",
+			time.Now().Add(config.deletionRequestWait()).UTC().Format(time.RFC1123))
+	}
+	text += fmt.Sprintf("\nRun `/%s %s %s` to cancel the request before then.", Trigger, ModeRequestDeletion, RequestCancel)
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func (p *Plugin) executeCancelDeletionCommand(args *model.CommandArgs) *model.CommandResponse {
+	var request *deletionRequest
+	if err := p.pluginClient.KV.Get(DeletionRequestKeyPrefix+args.UserId, &request); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not retrieve your deletion request: %s", err.Error()),
+		}
+	}
+	if request == nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "You have no pending deletion request.",
+		}
+	}
+
+	if err := p.pluginClient.KV.Delete(DeletionRequestKeyPrefix + args.UserId); err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Could not cancel your deletion request: %s", err.Error()),
+		}
+	}
+
+	p.pluginClient.Log.Info("User cancelled their deletion request", "user_id", args.UserId)
+	if channelID := p.getConfiguration().DeletionRequestsChannelID; channelID != "" {
+		username := args.UserId
+		if user, err := p.pluginClient.User.Get(args.UserId); err == nil {
+			username = "@" + user.Username
+		}
+		if err := p.pluginClient.Post.CreatePost(&model.Post{
+			UserId:    p.botUserID,
+			ChannelId: channelID,
+			Message:   fmt.Sprintf("%s cancelled their request to delete their account.", username),
+		}); err != nil {
+			p.pluginClient.Log.Error("Unable to post cancelled deletion request", "error", err)
+		}
+	}
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         "Your deletion request is cancelled.",
+	}
+}
+
+// deletionRequestWait returns how long requests wait before they're approved
+// automatically.
+func (c *configuration) deletionRequestWait() time.Duration {
+	wait := time.Duration(c.DeletionRequestWaitingHours) * time.Hour
+	if wait < minDeletionRequestWait {
+		return minDeletionRequestWait
+	}
+	return wait
+}
+
+// selectDueRequests returns the requests that have waited long enough to be
+// approved automatically.
+func selectDueRequests(requests []*deletionRequest, now time.Time, wait time.Duration) []*deletionRequest {
+	var due []*deletionRequest
+	for _, request := range requests {
+		if !time.UnixMilli(request.RequestedAt).Add(wait).After(now) {
+			due = append(due, request)
+		}
+	}
+	return due
+}
+
+func (p *Plugin) executeListRequestsCommand() *model.CommandResponse {
+	requests, err := getDeletionRequests(p.pluginClient)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to retrieve deletion requests: %s", err.Error()),
+		}
+	}
+	if len(requests) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "There are no pending deletion requests.",
+		}
+	}
+
+	var list strings.Builder
+	list.WriteString("Pending deletion requests:")
+	for _, request := range requests {
+		username := request.UserID
+		if user, err := p.pluginClient.User.Get(request.UserID); err == nil {
+			username = "@" + user.Username
+		}
+		fmt.Fprintf(&list, "\n- %s (`%s`), requested %s", username, request.UserID,
+			time.UnixMilli(request.RequestedAt).UTC().Format(time.RFC1123))
+	}
+	fmt.Fprintf(&list, "\n\nRun `/%s %s [user ID | %s]` to approve them.", Trigger, ModeApproveRequests, UsersAll)
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         list.String(),
+	}
+}
+
+func (p *Plugin) executeApproveRequestsCommand(args *model.CommandArgs, target string) *model.CommandResponse {
+	requests, err := getDeletionRequests(p.pluginClient)
+	if err != nil {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         fmt.Sprintf("Unable to retrieve deletion requests: %s", err.Error()),
+		}
+	}
+
+	var approved []*deletionRequest
+	for _, request := range requests {
+		if target == UsersAll || request.UserID == target {
+			approved = append(approved, request)
+		}
+	}
+
+	usersToDelete := p.getRequestingUsers(approved)
+	if len(usersToDelete) == 0 {
+		return &model.CommandResponse{
+			ResponseType: model.CommandResponseTypeEphemeral,
+			Text:         "No matching deletion requests found.",
+		}
+	}
+
+	go p.runBulkDeleteJob(false, args.UserId, args.ChannelId, getUserIDs(usersToDelete), "")
+
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         fmt.Sprintf("Starting bulk user deletion job for %d requested deletions", len(usersToDelete)),
+	}
+}
+
+// processDeletionRequests drops the requests of users that no longer exist
+// and, if configured to, deletes the users with pending requests. It runs on
+// one server of the cluster at a time.
+func (p *Plugin) processDeletionRequests() {
+	requests, err := getDeletionRequests(p.pluginClient)
+	if err != nil {
+		p.pluginClient.Log.Error("Unable to list deletion requests", "error", err)
+		return
+	}
+
+	usersToDelete := p.getRequestingUsers(requests)
+
+	config := p.getConfiguration()
+	if !config.ApproveDeletionRequestsAutomatically || len(usersToDelete) == 0 {
+		return
+	}
+
+	// Only requests that have waited long enough are approved, so users
+	// can still cancel the others.
+	due := map[string]bool{}
+	for _, request := range selectDueRequests(requests, time.Now(), config.deletionRequestWait()) {
+		due[request.UserID] = true
+	}
+	var dueUsers []*model.User
+	for _, user := range usersToDelete {
+		if due[user.Id] {
+			dueUsers = append(dueUsers, user)
+		}
+	}
+	if len(dueUsers) == 0 {
+		return
+	}
+	usersToDelete = dueUsers
+	if config.DeletionRequestsChannelID == "" {
+		p.pluginClient.Log.Warn("Deletion requests are approved automatically, but no channel is configured for the report")
+		return
+	}
+
+	p.runBulkDeleteJob(false, p.botUserID, config.DeletionRequestsChannelID, getUserIDs(usersToDelete), "")
+}
+
+// dropDeletionRequests removes the deletion requests of users handed to a
+// job, so they aren't listed or approved again while the job runs.
+func dropDeletionRequests(client *pluginapi.Client, users []*model.User) {
+	for _, user := range users {
+		if err := client.KV.Delete(DeletionRequestKeyPrefix + user.Id); err != nil {
+			client.Log.Error("Unable to remove deletion request", "user_id", user.Id, "error", err)
+		}
+	}
+}
+
+// getRequestingUsers returns the users of the given requests, and drops the
+// requests of users that no longer exist.
+func (p *Plugin) getRequestingUsers(requests []*deletionRequest) []*model.User {
+	var users []*model.User
+	for _, request := range requests {
+		user, err := p.pluginClient.User.Get(request.UserID)
+		if err == pluginapi.ErrNotFound {
+			if err = p.pluginClient.KV.Delete(DeletionRequestKeyPrefix + request.UserID); err != nil {
+				p.pluginClient.Log.Error("Unable to remove deletion request", "user_id", request.UserID, "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			p.pluginClient.Log.Error("Unable to get requesting user", "user_id", request.UserID, "error", err)
+			continue
+		}
+		// Users made system administrators after requesting can't be deleted
+		if user.IsInRole(model.SystemAdminRoleId) {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func getDeletionRequests(client *pluginapi.Client) ([]*deletionRequest, error) {
+	keys, err := listKeysWithPrefix(client, DeletionRequestKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []*deletionRequest
+	for _, key := range keys {
+		var request *deletionRequest
+		if err := client.KV.Get(key, &request); err != nil {
+			return nil, fmt.Errorf("could not get deletion request %s: %s", key, err.Error())
+		}
+		if request != nil {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].RequestedAt < requests[j].RequestedAt
+	})
+	return requests, nil
+}
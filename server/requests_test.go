@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_selectDueRequests(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	requests := []*deletionRequest{
+		{UserID: "old", RequestedAt: now.Add(-73 * time.Hour).UnixMilli()},
+		{UserID: "exact", RequestedAt: now.Add(-72 * time.Hour).UnixMilli()},
+		{UserID: "recent", RequestedAt: now.Add(-time.Hour).UnixMilli()},
+	}
+
+	tests := []struct {
+		description string
+		config      configuration
+		expected    []string
+	}{{
+		description: "requests should wait for the waiting period",
+		config:      configuration{DeletionRequestWaitingHours: 72},
+		expected:    []string{"old", "exact"},
+	}, {
+		description: "waiting period should be at least a day",
+		config:      configuration{DeletionRequestWaitingHours: 0},
+		expected:    []string{"old", "exact"},
+	}, {
+		description: "longer waiting periods should hold requests back",
+		config:      configuration{DeletionRequestWaitingHours: 100},
+		expected:    nil,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var got []string
+			for _, request := range selectDueRequests(requests, now, test.config.deletionRequestWait()) {
+				got = append(got, request.UserID)
+			}
+			if len(got) != len(test.expected) {
+				t.Fatalf("expected: '%v', got: '%v'", test.expected, got)
+			}
+			for i := range got {
+				if got[i] != test.expected[i] {
+					t.Errorf("expected: '%v', got: '%v'", test.expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"gopkg.in/yaml.v2"
+)
+
+const RuleActionDelete = "delete"
+const RuleActionNullify = "nullify"
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// cleanupRule describes a custom table, such as one created by an in-house
+// plugin or integration, that stores Mattermost user IDs.
+type cleanupRule struct {
+	Table        string              `yaml:"table"`
+	UserIDColumn string              `yaml:"user_id_column"`
+	Action       string              `yaml:"action"`
+	Cascade      *cleanupRuleCascade `yaml:"cascade"`
+}
+
+// cleanupRuleCascade names a child table whose rows reference the rows a
+// delete rule removes.
+type cleanupRuleCascade struct {
+	Table            string `yaml:"table"`
+	ForeignKeyColumn string `yaml:"foreign_key_column"`
+	ParentKeyColumn  string `yaml:"parent_key_column"`
+}
+
+// parseCleanupRules parses a rules document, written either as YAML or JSON,
+// and checks that each rule is complete.
+func parseCleanupRules(document string) ([]cleanupRule, error) {
+	if strings.TrimSpace(document) == "" {
+		return nil, nil
+	}
+
+	var rules []cleanupRule
+	if err := yaml.UnmarshalStrict([]byte(document), &rules); err != nil {
+		return nil, fmt.Errorf("unable to parse rules: %s", err.Error())
+	}
+
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i+1, err.Error())
+		}
+	}
+	return rules, nil
+}
+
+func (r *cleanupRule) validate() error {
+	if !identifierPattern.MatchString(r.Table) {
+		return fmt.Errorf("invalid table name '%s'", r.Table)
+	}
+	if !identifierPattern.MatchString(r.UserIDColumn) {
+		return fmt.Errorf("invalid user ID column name '%s'", r.UserIDColumn)
+	}
+	if r.Action != RuleActionDelete && r.Action != RuleActionNullify {
+		return fmt.Errorf("invalid action '%s'. Must be '%s' or '%s'", r.Action, RuleActionDelete, RuleActionNullify)
+	}
+
+	if r.Cascade == nil {
+		return nil
+	}
+	if r.Action != RuleActionDelete {
+		return fmt.Errorf("a cascade can only be used with the '%s' action", RuleActionDelete)
+	}
+	if r.Cascade.ParentKeyColumn == "" {
+		r.Cascade.ParentKeyColumn = "id"
+	}
+	if !identifierPattern.MatchString(r.Cascade.Table) {
+		return fmt.Errorf("invalid cascade table name '%s'", r.Cascade.Table)
+	}
+	if !identifierPattern.MatchString(r.Cascade.ForeignKeyColumn) {
+		return fmt.Errorf("invalid cascade foreign key column name '%s'", r.Cascade.ForeignKeyColumn)
+	}
+	if !identifierPattern.MatchString(r.Cascade.ParentKeyColumn) {
+		return fmt.Errorf("invalid cascade parent key column name '%s'", r.Cascade.ParentKeyColumn)
+	}
+	return nil
+}
+
+// validateCleanupRulesSchema checks the rules against the live schema, and
+// rewrites their table and column names to match the database's.
+func validateCleanupRulesSchema(db *database, rules []cleanupRule) error {
+	tables, err := getTableNames(db)
+	if err != nil {
+		return err
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		table, columns, err := lookupRuleTable(db, tables, rule.Table)
+		if err != nil {
+			return fmt.Errorf("rule %d: %s", i+1, err.Error())
+		}
+		rule.Table = table
+
+		userIDColumn, ok := columns[strings.ToLower(rule.UserIDColumn)]
+		if !ok {
+			return fmt.Errorf("rule %d: column '%s' does not exist in table '%s'", i+1, rule.UserIDColumn, rule.Table)
+		}
+		if rule.Action == RuleActionNullify && !userIDColumn.Nullable {
+			return fmt.Errorf("rule %d: column '%s' in table '%s' can't be nulled", i+1, rule.UserIDColumn, rule.Table)
+		}
+		rule.UserIDColumn = userIDColumn.Name
+
+		if rule.Cascade == nil {
+			continue
+		}
+
+		parentKeyColumn, ok := columns[strings.ToLower(rule.Cascade.ParentKeyColumn)]
+		if !ok {
+			return fmt.Errorf("rule %d cascade: column '%s' does not exist in table '%s'", i+1, rule.Cascade.ParentKeyColumn, rule.Table)
+		}
+		rule.Cascade.ParentKeyColumn = parentKeyColumn.Name
+
+		cascadeTable, cascadeColumns, err := lookupRuleTable(db, tables, rule.Cascade.Table)
+		if err != nil {
+			return fmt.Errorf("rule %d cascade: %s", i+1, err.Error())
+		}
+		rule.Cascade.Table = cascadeTable
+
+		foreignKeyColumn, ok := cascadeColumns[strings.ToLower(rule.Cascade.ForeignKeyColumn)]
+		if !ok {
+			return fmt.Errorf("rule %d cascade: column '%s' does not exist in table '%s'", i+1, rule.Cascade.ForeignKeyColumn, rule.Cascade.Table)
+		}
+		rule.Cascade.ForeignKeyColumn = foreignKeyColumn.Name
+	}
+	return nil
+}
+
+func lookupRuleTable(db *database, tables map[string]string, name string) (string, map[string]columnInfo, error) {
+	table, ok := tables[strings.ToLower(name)]
+	if !ok {
+		return "", nil, fmt.Errorf("table '%s' does not exist", name)
+	}
+
+	columns, err := getTableColumns(db, table)
+	if err != nil {
+		return "", nil, err
+	}
+	return table, columns, nil
+}
+
+// purgeCustomRuleData applies each rule to the rows of the given user.
+func purgeCustomRuleData(db *database, rules []cleanupRule, userID string) (err error) {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error when trying to begin transaction: %s", err.Error())
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+			err = fmt.Errorf("error when trying to rollback transaction: %s on error: %s",
+				rollbackErr.Error(), err.Error())
+		}
+	}()
+
+	for _, rule := range rules {
+		userIDColumn := db.quoteIdentifier(rule.UserIDColumn)
+
+		if rule.Cascade != nil {
+			parentKeysQueryString, parentKeysArgs, err := sq.Select(db.quoteIdentifier(rule.Cascade.ParentKeyColumn)).
+				From(db.quoteIdentifier(rule.Table)).
+				Where(sq.Eq{userIDColumn: userID}).
+				ToSql()
+			if err != nil {
+				return fmt.Errorf("error when trying to build the %s parent keys query: %s", rule.Table, err.Error())
+			}
+
+			cascadeDeleteQueryString, cascadeDeleteArgs, err := sq.Delete(db.quoteIdentifier(rule.Cascade.Table)).
+				Where(sq.Expr(db.quoteIdentifier(rule.Cascade.ForeignKeyColumn)+" IN ("+parentKeysQueryString+")", parentKeysArgs...)).
+				PlaceholderFormat(db.placeholder()).
+				ToSql()
+			if err != nil {
+				return fmt.Errorf("error when trying to build the %s cascade delete query: %s", rule.Cascade.Table, err.Error())
+			}
+
+			if _, err = tx.Exec(cascadeDeleteQueryString, cascadeDeleteArgs...); err != nil {
+				return fmt.Errorf("error when trying to delete user rows from %s: %s", rule.Cascade.Table, err.Error())
+			}
+		}
+
+		var query sq.Sqlizer
+		if rule.Action == RuleActionNullify {
+			query = sq.Update(db.quoteIdentifier(rule.Table)).
+				Set(userIDColumn, nil).
+				Where(sq.Eq{userIDColumn: userID}).
+				PlaceholderFormat(db.placeholder())
+		} else {
+			query = sq.Delete(db.quoteIdentifier(rule.Table)).
+				Where(sq.Eq{userIDColumn: userID}).
+				PlaceholderFormat(db.placeholder())
+		}
+
+		queryString, args, err := query.ToSql()
+		if err != nil {
+			return fmt.Errorf("error when trying to build the %s %s query: %s", rule.Table, rule.Action, err.Error())
+		}
+
+		if _, err = tx.Exec(queryString, args...); err != nil {
+			return fmt.Errorf("error when trying to %s user rows in %s: %s", rule.Action, rule.Table, err.Error())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error when trying to commit the transaction: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_parseCleanupRules(t *testing.T) {
+	tests := []struct {
+		description   string
+		document      string
+		expectErr     bool
+		expectedRules int
+	}{{
+		description: "empty document has no rules",
+		document:    "  ",
+	}, {
+		description: "json rules",
+		document: `[
+			{"table": "custom_settings", "user_id_column": "user_id", "action": "delete"},
+			{"table": "custom_audit", "user_id_column": "actor_id", "action": "nullify"}
+		]`,
+		expectedRules: 2,
+	}, {
+		description: "yaml rules with cascade",
+		document: `
+- table: custom_settings
+  user_id_column: user_id
+  action: delete
+  cascade:
+    table: custom_setting_values
+    foreign_key_column: setting_id
+`,
+		expectedRules: 1,
+	}, {
+		description: "unknown action",
+		document:    `[{"table": "custom_settings", "user_id_column": "user_id", "action": "archive"}]`,
+		expectErr:   true,
+	}, {
+		description: "missing user id column",
+		document:    `[{"table": "custom_settings", "action": "delete"}]`,
+		expectErr:   true,
+	}, {
+		description: "unsafe table name",
+		document:    `[{"table": "custom_settings; DROP TABLE Users", "user_id_column": "user_id", "action": "delete"}]`,
+		expectErr:   true,
+	}, {
+		description: "cascade with nullify",
+		document:    `[{"table": "custom_settings", "user_id_column": "user_id", "action": "nullify", "cascade": {"table": "custom_setting_values", "foreign_key_column": "setting_id"}}]`,
+		expectErr:   true,
+	}, {
+		description: "unknown field",
+		document:    `[{"table": "custom_settings", "user_id_column": "user_id", "action": "delete", "column": "user_id"}]`,
+		expectErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rules, err := parseCleanupRules(test.document)
+			if test.expectErr && err == nil {
+				t.Errorf("did not get expected error")
+				return
+			}
+			if !test.expectErr && err != nil {
+				t.Errorf("got unexpected error: %s", err.Error())
+				return
+			}
+			if len(rules) != test.expectedRules {
+				t.Errorf("expected: '%d' rules, got: '%d'", test.expectedRules, len(rules))
+			}
+		})
+	}
+}
+
+func Test_parseCleanupRules_defaultsParentKeyColumn(t *testing.T) {
+	rules, err := parseCleanupRules(`[{"table": "a", "user_id_column": "user_id", "action": "delete", "cascade": {"table": "b", "foreign_key_column": "a_id"}}]`)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err.Error())
+	}
+	if got := rules[0].Cascade.ParentKeyColumn; got != "id" {
+		t.Errorf("expected: 'id', got: '%s'", got)
+	}
+}
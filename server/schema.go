@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// getTableNames maps the lowercased name of every table in the current schema
+// to its actual name. Not every Mattermost schema version has every table, so
+// callers use this to skip tables that don't exist yet.
+func getTableNames(db *database) (map[string]string, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+			SELECT table_name FROM information_schema.tables
+			  WHERE table_schema = %s;
+		`, db.currentSchema()))
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to list tables: %s", err.Error())
+	}
+	defer rows.Close()
+
+	tables := map[string]string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("error parsing table names: %s", err.Error())
+		}
+		tables[strings.ToLower(name)] = name
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to list tables: %s", err.Error())
+	}
+
+	return tables, nil
+}
+
+type columnInfo struct {
+	Name     string
+	Nullable bool
+}
+
+// getTableColumns maps the lowercased name of every column of the given table
+// to its actual name and whether it is nullable.
+func getTableColumns(db *database, table string) (map[string]columnInfo, error) {
+	query := sq.Select("column_name", "is_nullable").
+		From("information_schema.columns").
+		Where("table_schema = " + db.currentSchema()).
+		Where(sq.Eq{"table_name": table}).
+		PlaceholderFormat(db.placeholder())
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the table columns query: %s", err.Error())
+	}
+
+	rows, err := db.Query(queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to list columns of %s: %s", table, err.Error())
+	}
+	defer rows.Close()
+
+	columns := map[string]columnInfo{}
+	for rows.Next() {
+		var name, nullable string
+		if err := rows.Scan(&name, &nullable); err != nil {
+			return nil, fmt.Errorf("error parsing columns of %s: %s", table, err.Error())
+		}
+		columns[strings.ToLower(name)] = columnInfo{Name: name, Nullable: nullable == "YES"}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to list columns of %s: %s", table, err.Error())
+	}
+
+	return columns, nil
+}
+
+// userIDColumnNames are the column names that conventionally hold a user ID
+// across Mattermost and plugin tables.
+var userIDColumnNames = []string{"userid", "user_id", "creatorid", "ownerid", "memberid"}
+
+// userIDLookupBatchSize bounds the number of user IDs sent in a single query.
+const userIDLookupBatchSize = 1000
+
+type tableColumn struct {
+	Table  string
+	Column string
+}
+
+// userReference records how many rows of a table column still hold a user ID.
+type userReference struct {
+	Table  string
+	Column string
+	UserID string
+	Count  int64
+}
+
+// findUserIDColumns scans the current schema for text columns named like a
+// user ID column. This catches tables added in newer server and plugin
+// versions that the cleanup stages don't know about yet.
+func findUserIDColumns(db *database) ([]tableColumn, error) {
+	query := sq.Select("table_name", "column_name").
+		From("information_schema.columns").
+		Where("table_schema = "+db.currentSchema()).
+		Where(sq.Eq{"lower(column_name)": userIDColumnNames}).
+		Where(sq.Eq{"data_type": []string{"character varying", "character", "varchar", "char", "text"}}).
+		OrderBy("table_name", "column_name").
+		PlaceholderFormat(db.placeholder())
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to build the user ID column query: %s", err.Error())
+	}
+
+	rows, err := db.Query(queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find user ID columns: %s", err.Error())
+	}
+	defer rows.Close()
+
+	var columns []tableColumn
+	for rows.Next() {
+		var column tableColumn
+		if err := rows.Scan(&column.Table, &column.Column); err != nil {
+			return nil, fmt.Errorf("error parsing user ID columns: %s", err.Error())
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to find user ID columns: %s", err.Error())
+	}
+
+	return columns, nil
+}
+
+// findUserReferences counts the rows in each of the given columns that still
+// reference one of the given user IDs.
+func findUserReferences(db *database, columns []tableColumn, userIDs []string) ([]userReference, error) {
+	var references []userReference
+	for _, column := range columns {
+		for start := 0; start < len(userIDs); start += userIDLookupBatchSize {
+			end := start + userIDLookupBatchSize
+			if end > len(userIDs) {
+				end = len(userIDs)
+			}
+
+			quotedColumn := db.quoteIdentifier(column.Column)
+			query := sq.Select(quotedColumn, "COUNT(*)").
+				From(db.quoteIdentifier(column.Table)).
+				Where(sq.Eq{quotedColumn: userIDs[start:end]}).
+				GroupBy(quotedColumn).
+				PlaceholderFormat(db.placeholder())
+
+			queryString, args, err := query.ToSql()
+			if err != nil {
+				return nil, fmt.Errorf("error when trying to build the user reference query for %s.%s: %s", column.Table, column.Column, err.Error())
+			}
+
+			found, err := scanUserReferences(db, column, queryString, args)
+			if err != nil {
+				return nil, err
+			}
+			references = append(references, found...)
+		}
+	}
+	return references, nil
+}
+
+func scanUserReferences(db *database, column tableColumn, queryString string, args []interface{}) ([]userReference, error) {
+	rows, err := db.Query(queryString, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error when trying to find user references in %s.%s: %s", column.Table, column.Column, err.Error())
+	}
+	defer rows.Close()
+
+	var references []userReference
+	for rows.Next() {
+		reference := userReference{Table: column.Table, Column: column.Column}
+		if err := rows.Scan(&reference.UserID, &reference.Count); err != nil {
+			return nil, fmt.Errorf("error parsing user references in %s.%s: %s", column.Table, column.Column, err.Error())
+		}
+		references = append(references, reference)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error when trying to find user references in %s.%s: %s", column.Table, column.Column, err.Error())
+	}
+
+	return references, nil
+}
+
+// formatUserReferences renders user references as CSV so that the report can
+// be used to drive a follow-up cleanup.
+func formatUserReferences(references []userReference) (string, error) {
+	var report strings.Builder
+	writer := csv.NewWriter(&report)
+	if err := writer.Write([]string{"table", "column", "user_id", "rows"}); err != nil {
+		return "", err
+	}
+	for _, reference := range references {
+		if err := writer.Write([]string{reference.Table, reference.Column, reference.UserID, strconv.FormatInt(reference.Count, 10)}); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+	return report.String(), nil
+}
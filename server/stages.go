@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+// cleanupStage removes the data an integration keeps for deleted users. Each
+// integration lives in its own file and is added to cleanupStages below.
+type cleanupStage interface {
+	// Name identifies the stage in the plugin settings and job reports.
+	Name() string
+	// IsApplicable reports whether the stage has data to clean up on this
+	// server and, if not, why it is skipped.
+	IsApplicable(env *cleanupEnv) (bool, string)
+	// DryRunCount returns how many records the stage would remove or change
+	// if the target users were deleted.
+	DryRunCount(env *cleanupEnv) (int, error)
+	// DryRunLabel describes what DryRunCount counts, following the count in
+	// the dry run report.
+	DryRunLabel() string
+	// Prepare checks the stage's settings and resolves the users it needs
+	// before any user is deleted, so a bad setting can't fail the job
+	// halfway through.
+	Prepare(env *cleanupEnv) error
+	// Purge removes the data left behind by the deleted users.
+	Purge(env *cleanupEnv) error
+	// Verify returns the stage's data still referencing the deleted users.
+	Verify(env *cleanupEnv) ([]userReference, error)
+}
+
+// cleanupStages lists the registered stages in the order they run. The
+// playbook-runs stage runs before the playbooks stage, which removes the
+// deleted users' run participations it uses to find abandoned runs.
+var cleanupStages = []cleanupStage{
+	boardsStage{},
+	playbookRunsStage{},
+	playbooksStage{},
+}
+
+// cleanupEnv holds what a cleanup stage needs to clean up after a job.
+type cleanupEnv struct {
+	db           *database
+	tables       map[string]string
+	pluginClient *pluginapi.Client
+	config       *configuration
+	userIDs      []string
+
+	// deletionJob and statusPost are only set while a live job runs, for
+	// stages that record their results or post files to the job's thread.
+	deletionJob *job
+	statusPost  *model.Post
+
+	// boardsPlaceholderUserID and playbooksFallbackUserID are resolved by
+	// the stages' Prepare.
+	boardsPlaceholderUserID string
+	playbooksFallbackUserID string
+}
+
+func newCleanupEnv(pluginClient *pluginapi.Client, config *configuration, userIDs []string) (*cleanupEnv, error) {
+	db, err := getDatabase(pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing database: %s", err.Error())
+	}
+
+	tables, err := getTableNames(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cleanupEnv{
+		db:           db,
+		tables:       tables,
+		pluginClient: pluginClient,
+		config:       config,
+		userIDs:      userIDs,
+	}, nil
+}
+
+// selectCleanupStages splits the registered stages into those that apply to
+// this server and a description of each stage that is skipped.
+func selectCleanupStages(env *cleanupEnv) ([]cleanupStage, []string) {
+	disabled := map[string]bool{}
+	for _, name := range env.config.DisabledCleanupStages() {
+		disabled[name] = true
+	}
+
+	var stages []cleanupStage
+	var skipped []string
+	for _, stage := range cleanupStages {
+		if disabled[stage.Name()] {
+			skipped = append(skipped, fmt.Sprintf("%s: disabled in the plugin settings", stage.Name()))
+			continue
+		}
+		if ok, reason := stage.IsApplicable(env); !ok {
+			skipped = append(skipped, fmt.Sprintf("%s: %s", stage.Name(), reason))
+			continue
+		}
+		stages = append(stages, stage)
+	}
+	return stages, skipped
+}
+
+// resolveReplacementUser returns the ID of the user a stage reassigns the
+// deleted users' data to. The user must exist and must not be one of the
+// users being deleted.
+func resolveReplacementUser(env *cleanupEnv, description, username string) (string, error) {
+	user, err := env.pluginClient.User.GetByUsername(username)
+	if err != nil {
+		return "", fmt.Errorf("error finding %s %s: %s", description, username, err.Error())
+	}
+	for _, id := range env.userIDs {
+		if id == user.Id {
+			return "", fmt.Errorf("the %s %s is one of the users being deleted", description, username)
+		}
+	}
+	return user.Id, nil
+}
+
+// integration describes a plugin whose data a cleanup stage removes. The
+// stage is skipped on servers where the plugin's tables don't exist, such as
+// servers that never had the plugin installed.
+type integration struct {
+	PluginID string
+	Tables   []string
+}
+
+// detectIntegration reports whether all of the integration's tables exist.
+// If they don't, it also returns the reason the integration is skipped.
+func detectIntegration(env *cleanupEnv, i integration) (bool, string) {
+	var missing []string
+	for _, table := range i.Tables {
+		if _, ok := env.tables[table]; !ok {
+			missing = append(missing, table)
+		}
+	}
+	if len(missing) == 0 {
+		return true, ""
+	}
+
+	status, err := env.pluginClient.Plugin.GetPluginStatus(i.PluginID)
+	switch {
+	case err != nil:
+		return false, fmt.Sprintf("the %s plugin is not installed", i.PluginID)
+	case status.State != model.PluginStateRunning:
+		return false, fmt.Sprintf("the %s plugin is not running and its tables were not found", i.PluginID)
+	default:
+		return false, fmt.Sprintf("tables %v were not found", missing)
+	}
+}
+
+// verifyTableColumns returns the rows of the given columns still referencing
+// the deleted users. Columns of tables that don't exist are skipped.
+func verifyTableColumns(env *cleanupEnv, columns []tableColumn) ([]userReference, error) {
+	var existing []tableColumn
+	for _, column := range columns {
+		table, ok := env.tables[column.Table]
+		if !ok {
+			continue
+		}
+		existing = append(existing, tableColumn{table, column.Column})
+	}
+	return findUserReferences(env.db, existing, env.userIDs)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi"
+)
+
+const StagedUserKeyPrefix = "com.mattermost.plugin-bulk-user-delete/staged/"
+const StagedDeletionJobKey = "com.mattermost.plugin-bulk-user-delete/staged-deletion"
+
+const stagedDeletionInterval = time.Hour
+const kvListPageSize = 1000
+
+// stagedUser is a user deactivated by a stage job, due to be permanently
+// deleted once their grace period has passed.
+type stagedUser struct {
+	UserID    string
+	StagedAt  int64
+	DeleteAt  int64
+	StagedBy  string
+	ChannelID string
+	Profile   string
+	// EnabledStages and DisabledStages are the stages the profile enabled
+	// and disabled when the user was staged, so they keep applying even if
+	// the profile is deleted. DisabledStages is nil for users staged without
+	// a record of them.
+	EnabledStages  []string
+	DisabledStages []string
+}
+
+// deletionGracePeriod returns how long staged users stay deactivated before
+// they are deleted.
+func (c *configuration) deletionGracePeriod() time.Duration {
+	days := c.DeletionGracePeriodDays
+	if days < 0 {
+		days = 0
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// runStageJob deactivates the given users and schedules them for deletion
+// once the grace period has passed, with the profile's cleanup options if
+// profile isn't nil. If userListName isn't empty, the list of target users is
+// attached to the status post under that name.
+func (p *Plugin) runStageJob(runningUserID string, runningChannelID string, userIDs []string, userListName string, profile *cleanupProfile) {
+	statusPost := &model.Post{
+		UserId:    runningUserID,
+		ChannelId: runningChannelID,
+		Message:   fmt.Sprintf("### Bulk user staging job started\nDeactivating %d users...", len(userIDs)),
+	}
+	if userListName != "" && len(userIDs) > 0 {
+		userListFileID, err := uploadUserList(p.pluginClient, p.socketClient, runningChannelID, userIDs, userListName)
+		if err != nil {
+			p.pluginClient.Log.Error("Unable to upload list of target users", "error", err)
+			statusPost.Message = fmt.Sprintf("### Bulk user staging job failed!\nUnable to upload list of target users: %s", err.Error())
+			if err = p.pluginClient.Post.CreatePost(statusPost); err != nil {
+				p.pluginClient.Log.Error("Unable to create status post", "error", err)
+			}
+			return
+		}
+		statusPost.FileIds = model.StringArray{userListFileID}
+	}
+	if err := p.pluginClient.Post.CreatePost(statusPost); err != nil {
+		p.pluginClient.Log.Error("Bulk stage job unable to create status post. Aborting...")
+		return
+	}
+
+	now := time.Now()
+	deleteAt := now.Add(p.getConfiguration().deletionGracePeriod())
+
+	var notices *noticeSender
+	if p.getConfiguration().NotifyStagedUsers {
+		var err error
+		if notices, err = p.newNoticeSender(); err != nil {
+			p.pluginClient.Log.Error("Bulk stage job failed", "error", err)
+			statusPost.Message = fmt.Sprintf("### Bulk user staging job failed!\n%s", err.Error())
+			if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
+				p.pluginClient.Log.Error("Unable to update status post", "error", err)
+			}
+			return
+		}
+	}
+	var profileName string
+	var enabledStages, disabledStages []string
+	if profile != nil {
+		profileName = profile.Name
+		// An empty list records that the profile disabled no stages.
+		enabledStages = profile.EnabledStages
+		disabledStages = append([]string{}, profile.DisabledStages...)
+	}
+
+	var staged, alreadyStaged int
+	err := forEachUserBatch(p.socketClient, userIDs, userBatchSize, func(_ int, users []*model.User) error {
+		for _, user := range users {
+			wasActive := user.DeleteAt == 0
+
+			// Users staged earlier keep their original deletion date.
+			entry := stagedUser{
+				UserID:         user.Id,
+				StagedAt:       model.GetMillisForTime(now),
+				DeleteAt:       model.GetMillisForTime(deleteAt),
+				StagedBy:       runningUserID,
+				ChannelID:      runningChannelID,
+				Profile:        profileName,
+				EnabledStages:  enabledStages,
+				DisabledStages: disabledStages,
+			}
+			set, err := p.pluginClient.KV.Set(StagedUserKeyPrefix+user.Id, entry, pluginapi.SetAtomic(nil))
+			if err != nil {
+				return fmt.Errorf("unable to stage user %s: %s", user.Id, err.Error())
+			}
+
+			// Users are only notified once their deletion date is stored,
+			// and only if they were active before this job. Notices are
+			// sent before deactivating them, so they can still read the
+			// direct message.
+			if set && notices != nil && wasActive {
+				if err := notices.send(user, entry.DeleteAt); err != nil {
+					p.unstageUser(user.Id)
+					return fmt.Errorf("unable to send deletion notice: %s", err.Error())
+				}
+			}
+
+			if wasActive {
+				if err := p.pluginClient.User.UpdateActive(user.Id, false); err != nil {
+					if set {
+						p.unstageUser(user.Id)
+					}
+					return fmt.Errorf("unable to deactivate user %s: %s", user.Id, err.Error())
+				}
+			}
+			if set {
+				staged++
+			} else {
+				alreadyStaged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		p.pluginClient.Log.Error("Bulk stage job failed", "error", err)
+		statusPost.Message = fmt.Sprintf("### Bulk user staging job failed!\n%s\nStaged %d/%d users.", err.Error(), staged+alreadyStaged, len(userIDs))
+		if err = p.pluginClient.Post.UpdatePost(statusPost); err != nil {
+			p.pluginClient.Log.Error("Unable to update status post", "error", err)
+		}
+		return
+	}
+
+	statusPost.Message = fmt.Sprintf("### Bulk user staging job finished\nDeactivated and staged %d users. They will be permanently deleted after %s unless they are reactivated.",
+		staged, deleteAt.UTC().Format(time.RFC1123))
+	if alreadyStaged > 0 {
+		statusPost.Message += fmt.Sprintf("\n%d users were already staged and keep their original deletion date.", alreadyStaged)
+	}
+	if notices != nil {
+		statusPost.Message += notices.results.describe()
+	}
+	if err := p.pluginClient.Post.UpdatePost(statusPost); err != nil {
+		p.pluginClient.Log.Error("Unable to update status post", "error", err)
+	}
+}
+
+// runStagedDeletions permanently deletes the staged users whose grace period
+// has passed. It runs on one server of the cluster at a time.
+func (p *Plugin) runStagedDeletions() {
+	entries, err := getStagedUsers(p.pluginClient)
+	if err != nil {
+		p.pluginClient.Log.Error("Unable to list staged users", "error", err)
+		return
+	}
+
+	// Due users are deleted in one job per admin, channel and profile that
+	// staged them, so each admin gets the report in their own channel.
+	type jobTarget struct {
+		userID, channelID, profile    string
+		enabledStages, disabledStages string
+		recorded                      bool
+	}
+	var targets []jobTarget
+	dueUsers := map[jobTarget][]string{}
+	stagedEntries := map[jobTarget]*stagedUser{}
+
+	now := model.GetMillis()
+	for _, entry := range entries {
+		user, err := p.pluginClient.User.Get(entry.UserID)
+		if err == pluginapi.ErrNotFound {
+			user = nil
+		} else if err != nil {
+			p.pluginClient.Log.Error("Unable to get staged user", "user_id", entry.UserID, "error", err)
+			continue
+		}
+
+		due, drop := checkStagedUser(entry, user, now)
+		if drop {
+			p.unstageUser(entry.UserID)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		target := jobTarget{entry.StagedBy, entry.ChannelID, entry.Profile,
+			strings.Join(entry.EnabledStages, ","), strings.Join(entry.DisabledStages, ","),
+			entry.DisabledStages != nil}
+		if _, ok := dueUsers[target]; !ok {
+			targets = append(targets, target)
+			stagedEntries[target] = entry
+		}
+		dueUsers[target] = append(dueUsers[target], user.Id)
+	}
+
+	// Each deleted user's entry is dropped by a later run once the user no
+	// longer exists, so users a failed job didn't delete are retried.
+	for _, target := range targets {
+		var profile *cleanupProfile
+		if target.profile != "" {
+			if profile, err = getProfile(p.pluginClient, target.profile); err != nil {
+				p.pluginClient.Log.Error("Unable to get profile of staged users", "profile", target.profile, "error", err)
+				continue
+			}
+			if profile == nil {
+				profile, err = deletedProfileForStagedUsers(stagedEntries[target])
+				if err != nil {
+					p.pluginClient.Log.Error("Leaving users staged", "profile", target.profile, "error", err)
+					continue
+				}
+				p.pluginClient.Log.Warn("Profile of staged users was deleted, using the stages it enabled and disabled when they were staged", "profile", target.profile)
+			}
+		}
+		p.runProfileJob(profile, false, target.userID, target.channelID, dueUsers[target], "")
+	}
+}
+
+// deletedProfileForStagedUsers stands in for a profile deleted after the
+// user was staged with it, enabling and disabling the stages recorded when
+// they were staged. Users staged without a record of them are left staged,
+// rather than risk running stages the profile disabled.
+func deletedProfileForStagedUsers(entry *stagedUser) (*cleanupProfile, error) {
+	if entry.DisabledStages == nil {
+		return nil, fmt.Errorf("profile %s was deleted and the stages it disabled weren't recorded when its users were staged; recreate the profile to delete them", entry.Profile)
+	}
+	return &cleanupProfile{Name: entry.Profile, EnabledStages: entry.EnabledStages, DisabledStages: entry.DisabledStages}, nil
+}
+
+// checkStagedUser reports whether a staged user is due to be deleted, or
+// should be dropped from the queue because they were reactivated or no longer
+// exist. A nil user means the user was not found.
+func checkStagedUser(entry *stagedUser, user *model.User, now int64) (due bool, drop bool) {
+	if user == nil || user.DeleteAt == 0 {
+		return false, true
+	}
+	return entry.DeleteAt <= now, false
+}
+
+func (p *Plugin) unstageUser(userID string) {
+	if err := p.pluginClient.KV.Delete(StagedUserKeyPrefix + userID); err != nil {
+		p.pluginClient.Log.Error("Unable to remove staged user", "user_id", userID, "error", err)
+	}
+}
+
+// UserHasLoggedIn takes users out of the deletion queue as soon as they log
+// in, which they can only do once reactivated.
+func (p *Plugin) UserHasLoggedIn(_ *plugin.Context, user *model.User) {
+	var entry *stagedUser
+	if err := p.pluginClient.KV.Get(StagedUserKeyPrefix+user.Id, &entry); err != nil || entry == nil {
+		return
+	}
+	p.pluginClient.Log.Info("Staged user was reactivated, cancelling their deletion", "user_id", user.Id)
+	p.unstageUser(user.Id)
+}
+
+func getStagedUsers(client *pluginapi.Client) ([]*stagedUser, error) {
+	keys, err := listKeysWithPrefix(client, StagedUserKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*stagedUser
+	for _, key := range keys {
+		var entry *stagedUser
+		if err := client.KV.Get(key, &entry); err != nil {
+			return nil, fmt.Errorf("could not get staged user %s: %s", key, err.Error())
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// listKeysWithPrefix returns every KV key with the given prefix.
+func listKeysWithPrefix(client *pluginapi.Client, prefix string) ([]string, error) {
+	var matching []string
+	for page := 0; ; page++ {
+		keys, err := client.KV.ListKeys(page, kvListPageSize)
+		if err != nil {
+			return nil, fmt.Errorf("could not list keys: %s", err.Error())
+		}
+		if len(keys) == 0 {
+			return matching, nil
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				matching = append(matching, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func Test_checkStagedUser(t *testing.T) {
+	const now = 2000
+
+	tests := []struct {
+		description  string
+		entry        stagedUser
+		user         *model.User
+		expectedDue  bool
+		expectedDrop bool
+	}{{
+		description:  "deleted user should be dropped",
+		entry:        stagedUser{DeleteAt: 1000},
+		expectedDrop: true,
+	}, {
+		description:  "reactivated user should be dropped",
+		entry:        stagedUser{DeleteAt: 1000},
+		user:         &model.User{DeleteAt: 0},
+		expectedDrop: true,
+	}, {
+		description: "deactivated user in grace period should wait",
+		entry:       stagedUser{DeleteAt: 3000},
+		user:        &model.User{DeleteAt: 500},
+	}, {
+		description: "deactivated user after grace period should be due",
+		entry:       stagedUser{DeleteAt: 2000},
+		user:        &model.User{DeleteAt: 500},
+		expectedDue: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			due, drop := checkStagedUser(&test.entry, test.user, now)
+			if due != test.expectedDue {
+				t.Errorf("expected due: '%t', got: '%t'", test.expectedDue, due)
+			}
+			if drop != test.expectedDrop {
+				t.Errorf("expected drop: '%t', got: '%t'", test.expectedDrop, drop)
+			}
+		})
+	}
+}
+
+func Test_deletedProfileForStagedUsers(t *testing.T) {
+	tests := []struct {
+		description    string
+		disabledStages []string
+		expectErr      bool
+	}{{
+		description:    "recorded stages should stay enabled and disabled",
+		disabledStages: []string{"boards"},
+	}, {
+		description:    "recorded empty list should disable no stages",
+		disabledStages: []string{},
+	}, {
+		description: "unrecorded stages should leave users staged",
+		expectErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			// Entries are stored as JSON, which must keep an empty list
+			// apart from a missing one.
+			data, err := json.Marshal(stagedUser{Profile: "contractors", EnabledStages: []string{"playbook-runs"}, DisabledStages: test.disabledStages})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			var entry stagedUser
+			if err = json.Unmarshal(data, &entry); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			profile, err := deletedProfileForStagedUsers(&entry)
+			if test.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if profile.Name != "contractors" || len(profile.DisabledStages) != len(test.disabledStages) {
+				t.Errorf("expected: '%v', got: '%v'", test.disabledStages, profile.DisabledStages)
+			}
+			if len(profile.EnabledStages) != 1 || profile.EnabledStages[0] != "playbook-runs" {
+				t.Errorf("expected: '%v', got: '%v'", []string{"playbook-runs"}, profile.EnabledStages)
+			}
+		})
+	}
+}
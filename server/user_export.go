@@ -0,0 +1,421 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// userExport records where a user's data was exported before they were
+// deleted.
+type userExport struct {
+	UserID    string
+	Username  string
+	Path      string
+	FileID    string
+	Encrypted bool
+}
+
+// userExportQuery selects a kind of user data to export, one JSON object per
+// row. Queries on tables missing from the server are skipped.
+type userExportQuery struct {
+	name  string
+	table string
+	query func(userID string) sq.SelectBuilder
+}
+
+var userExportQueries = []userExportQuery{
+	{"team_memberships", "teammembers", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("TeamMembers").Where(sq.Eq{"UserId": userID})
+	}},
+	{"channel_memberships", "channelmembers", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("ChannelMembers").Where(sq.Eq{"UserId": userID})
+	}},
+	{"posts", "posts", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("Posts").Where(sq.Eq{"UserId": userID}).OrderBy("CreateAt")
+	}},
+	{"reactions", "reactions", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("Reactions").Where(sq.Eq{"UserId": userID})
+	}},
+	{"files", "fileinfo", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("FileInfo").Where(sq.Eq{"CreatorId": userID})
+	}},
+	{"board_cards", "focalboard_blocks", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("focalboard_blocks").Where(sq.Eq{"created_by": userID, "type": "card"})
+	}},
+	{"playbook_runs", "ir_incident", func(userID string) sq.SelectBuilder {
+		return sq.Select("*").From("ir_incident").Where(sq.Or{
+			sq.Eq{"commanderuserid": userID},
+			sq.Expr("EXISTS (SELECT 1 FROM ir_run_participants WHERE ir_run_participants.incidentid = ir_incident.id AND ir_run_participants.userid = ?)", userID),
+		})
+	}},
+}
+
+// exportUsers writes a ZIP of each user's data before they are deleted, and
+// records each export on the job.
+func exportUsers(env *cleanupEnv, users []*model.User) error {
+	var publicKey *rsa.PublicKey
+	if env.config.UserExportPublicKey != "" {
+		var err error
+		if publicKey, err = parseExportPublicKey(env.config.UserExportPublicKey); err != nil {
+			return err
+		}
+	}
+
+	for _, user := range users {
+		export, err := exportUser(env, user, publicKey)
+		if err != nil {
+			return fmt.Errorf("error exporting data of user %s: %s", user.Id, err.Error())
+		}
+		if env.deletionJob != nil {
+			env.deletionJob.UserExports = append(env.deletionJob.UserExports, export)
+		}
+	}
+	return nil
+}
+
+func exportUser(env *cleanupEnv, user *model.User, publicKey *rsa.PublicKey) (userExport, error) {
+	export := userExport{UserID: user.Id, Username: user.Username, Encrypted: publicKey != nil}
+
+	// Posts and files can be large, so the export is written to a temporary
+	// file rather than kept in memory.
+	archiveFile, err := os.CreateTemp("", "bulk-user-delete-export-*.zip")
+	if err != nil {
+		return export, fmt.Errorf("error creating export file: %s", err.Error())
+	}
+	defer os.Remove(archiveFile.Name())
+	defer archiveFile.Close()
+
+	if err = writeUserExport(env, archiveFile, user); err != nil {
+		return export, err
+	}
+	if _, err = archiveFile.Seek(0, io.SeekStart); err != nil {
+		return export, fmt.Errorf("error reading export file: %s", err.Error())
+	}
+
+	var content io.Reader = archiveFile
+	exportName := fmt.Sprintf("%d-%s-export.zip", model.GetMillis(), user.Username)
+	if publicKey != nil {
+		encryptedFile, createErr := os.CreateTemp("", "bulk-user-delete-export-*.zip.enc")
+		if createErr != nil {
+			return export, fmt.Errorf("error creating export file: %s", createErr.Error())
+		}
+		defer os.Remove(encryptedFile.Name())
+		defer encryptedFile.Close()
+
+		if err = encryptExport(encryptedFile, archiveFile, publicKey); err != nil {
+			return export, fmt.Errorf("error encrypting export: %s", err.Error())
+		}
+		if _, err = encryptedFile.Seek(0, io.SeekStart); err != nil {
+			return export, fmt.Errorf("error reading export file: %s", err.Error())
+		}
+		content = encryptedFile
+		exportName += ".enc"
+	}
+
+	if directory := env.config.UserExportDirectory; directory != "" {
+		if err = os.MkdirAll(directory, 0700); err != nil {
+			return export, fmt.Errorf("error creating export directory: %s", err.Error())
+		}
+		export.Path = filepath.Join(directory, exportName)
+		exportFile, createErr := os.OpenFile(export.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if createErr != nil {
+			return export, fmt.Errorf("error creating export: %s", createErr.Error())
+		}
+		defer exportFile.Close()
+		if _, err = io.Copy(exportFile, content); err != nil {
+			return export, fmt.Errorf("error writing export: %s", err.Error())
+		}
+		return export, exportFile.Close()
+	}
+
+	if env.statusPost == nil {
+		return export, fmt.Errorf("no user export directory is configured")
+	}
+	if err = env.config.checkExportUploads(); err != nil {
+		return export, err
+	}
+	exportPost := &model.Post{
+		UserId:    env.statusPost.UserId,
+		ChannelId: env.config.UserExportChannelID,
+		Message:   fmt.Sprintf("Data export of @%s before deletion:", user.Username),
+	}
+	if exportPost.ChannelId == "" {
+		exportPost.ChannelId = env.statusPost.ChannelId
+		exportPost.RootId = env.statusPost.Id
+	}
+
+	fileInfo, err := env.pluginClient.File.Upload(content, exportName, exportPost.ChannelId)
+	if err != nil {
+		return export, fmt.Errorf("error uploading export: %s", err.Error())
+	}
+	export.FileID = fileInfo.Id
+	exportPost.FileIds = model.StringArray{fileInfo.Id}
+	if err = env.pluginClient.Post.CreatePost(exportPost); err != nil {
+		return export, fmt.Errorf("error posting export: %s", err.Error())
+	}
+	return export, nil
+}
+
+func writeUserExport(env *cleanupEnv, w io.Writer, user *model.User) error {
+	archive := zip.NewWriter(w)
+
+	profile := *user
+	profile.Sanitize(map[string]bool{})
+	profileEntry, err := archive.Create("profile.json")
+	if err != nil {
+		return fmt.Errorf("error writing export: %s", err.Error())
+	}
+	if err = json.NewEncoder(profileEntry).Encode(profile); err != nil {
+		return fmt.Errorf("error writing export profile: %s", err.Error())
+	}
+
+	for _, exportQuery := range userExportQueries {
+		if _, ok := env.tables[exportQuery.table]; !ok {
+			continue
+		}
+		entry, err := archive.Create(exportQuery.name + ".jsonl")
+		if err != nil {
+			return fmt.Errorf("error writing export: %s", err.Error())
+		}
+		if err = writeExportRows(env.db, entry, exportQuery.query(user.Id)); err != nil {
+			return fmt.Errorf("error exporting %s: %s", exportQuery.name, err.Error())
+		}
+	}
+
+	if err = writeUserExportFiles(env, archive, user.Id); err != nil {
+		return err
+	}
+
+	if err = archive.Close(); err != nil {
+		return fmt.Errorf("error writing export: %s", err.Error())
+	}
+	return nil
+}
+
+// writeExportRows writes each row of the query as a JSON object keyed by
+// column name.
+func writeExportRows(db *database, w io.Writer, query sq.SelectBuilder) error {
+	queryString, args, err := query.PlaceholderFormat(db.placeholder()).ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(queryString, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+
+		row := map[string]interface{}{}
+		for i, column := range columns {
+			if value, ok := values[i].([]byte); ok {
+				row[column] = string(value)
+				continue
+			}
+			row[column] = values[i]
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// writeUserExportFiles copies the content of each file the user uploaded into
+// the export. Files that can't be read are left out.
+func writeUserExportFiles(env *cleanupEnv, archive *zip.Writer, userID string) error {
+	queryString, args, err := sq.Select("Id", "Name").
+		From("FileInfo").
+		Where(sq.Eq{"CreatorId": userID}).
+		PlaceholderFormat(env.db.placeholder()).
+		ToSql()
+	if err != nil {
+		return fmt.Errorf("error when trying to build the user files query: %s", err.Error())
+	}
+
+	rows, err := env.db.Query(queryString, args...)
+	if err != nil {
+		return fmt.Errorf("error when trying to find user files: %s", err.Error())
+	}
+	defer rows.Close()
+
+	type fileEntry struct{ id, name string }
+	var files []fileEntry
+	for rows.Next() {
+		var file fileEntry
+		if err := rows.Scan(&file.id, &file.name); err != nil {
+			return fmt.Errorf("error parsing user files: %s", err.Error())
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error when trying to find user files: %s", err.Error())
+	}
+
+	for _, file := range files {
+		content, err := env.pluginClient.File.Get(file.id)
+		if err != nil {
+			env.pluginClient.Log.Warn("Unable to read file, leaving it out of the export", "user_id", userID, "file_id", file.id, "error", err)
+			continue
+		}
+		entry, err := archive.Create(fmt.Sprintf("files/%s/%s", file.id, filepath.Base(file.name)))
+		if err != nil {
+			return fmt.Errorf("error writing export: %s", err.Error())
+		}
+		if _, err := io.Copy(entry, content); err != nil {
+			return fmt.Errorf("error writing file %s to export: %s", file.id, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseExportPublicKey parses a PEM encoded RSA public key, in either PKIX or
+// PKCS #1 form.
+func parseExportPublicKey(key string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("user export public key is not PEM encoded")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse user export public key: %s", err.Error())
+		}
+		return publicKey, nil
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse user export public key: %s", err.Error())
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("user export public key must be an RSA key")
+	}
+	return publicKey, nil
+}
+
+// exportSegmentSize is the size of the plaintext segments an encrypted export
+// is sealed in, so exports are encrypted without holding them in memory.
+const exportSegmentSize = 64 * 1024
+
+// checkExportUploads returns an error if user exports would be posted to a
+// channel without encryption, unless that was explicitly allowed.
+func (c *configuration) checkExportUploads() error {
+	if c.UserExportDirectory != "" || c.UserExportPublicKey != "" || c.AllowUnencryptedExportUploads {
+		return nil
+	}
+	return fmt.Errorf("user exports can't be posted to a channel unencrypted: set a user export public key, a user export directory, or allow unencrypted export uploads")
+}
+
+// encryptExport encrypts the content with a random AES-256-GCM key, itself
+// encrypted with RSA-OAEP and SHA-256. The output is the encrypted key's
+// length as a big-endian uint16, the encrypted key, a 12 byte base nonce and
+// then the content sealed in segments of exportSegmentSize bytes. The nonce
+// of each segment is the base nonce with its last 8 bytes XORed with the
+// segment's big-endian index. The last segment is shorter than the others,
+// possibly empty, and is sealed with additional data of a single 1 byte,
+// while the others have a single 0 byte, so a truncated export can't be
+// decrypted.
+func encryptExport(w io.Writer, r io.Reader, publicKey *rsa.PublicKey) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	baseNonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(baseNonce); err != nil {
+		return err
+	}
+
+	header := make([]byte, 2, 2+len(encryptedKey)+len(baseNonce))
+	binary.BigEndian.PutUint16(header, uint16(len(encryptedKey)))
+	header = append(header, encryptedKey...)
+	header = append(header, baseNonce...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	plaintext := make([]byte, exportSegmentSize)
+	sealed := make([]byte, 0, exportSegmentSize+gcm.Overhead())
+	for index := uint64(0); ; index++ {
+		n, readErr := io.ReadFull(r, plaintext)
+		final := readErr == io.EOF || readErr == io.ErrUnexpectedEOF
+		if readErr != nil && !final {
+			return readErr
+		}
+
+		sealed = gcm.Seal(sealed[:0], exportSegmentNonce(baseNonce, index), plaintext[:n], exportSegmentData(final))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// exportSegmentNonce returns the nonce of the segment at index.
+func exportSegmentNonce(baseNonce []byte, index uint64) []byte {
+	nonce := make([]byte, len(baseNonce))
+	copy(nonce, baseNonce)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, index)
+	for i := range counter {
+		nonce[len(nonce)-8+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// exportSegmentData returns the additional data a segment is sealed with.
+func exportSegmentData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
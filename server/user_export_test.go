@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"testing"
+)
+
+func Test_encryptExport(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err.Error())
+	}
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty export", 0},
+		{"export smaller than a segment", 15},
+		{"export of exactly one segment", exportSegmentSize},
+		{"export spanning several segments", 2*exportSegmentSize + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			var encrypted bytes.Buffer
+			if err := encryptExport(&encrypted, bytes.NewReader(data), &privateKey.PublicKey); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			decrypted, err := decryptExport(encrypted.Bytes(), privateKey)
+			if err != nil {
+				t.Fatalf("unable to decrypt export: %s", err.Error())
+			}
+			if !bytes.Equal(decrypted, data) {
+				t.Errorf("expected: '%d' bytes, got: '%d' different bytes", len(data), len(decrypted))
+			}
+
+			// An export cut after a full segment must not decrypt.
+			if tt.size >= exportSegmentSize {
+				finalSegmentSize := tt.size%exportSegmentSize + 16
+				truncated := encrypted.Bytes()[:encrypted.Len()-finalSegmentSize]
+				if _, err := decryptExport(truncated, privateKey); err == nil {
+					t.Errorf("expected truncated export to fail decryption")
+				}
+			}
+		})
+	}
+}
+
+// decryptExport reverses encryptExport, following the format in the README.
+func decryptExport(encrypted []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	keyLength := int(binary.BigEndian.Uint16(encrypted))
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encrypted[2:2+keyLength], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce := encrypted[2+keyLength : 2+keyLength+gcm.NonceSize()]
+	rest := encrypted[2+keyLength+gcm.NonceSize():]
+
+	var decrypted []byte
+	segmentSize := exportSegmentSize + gcm.Overhead()
+	for index := uint64(0); ; index++ {
+		final := len(rest) < segmentSize
+		segment := rest
+		if !final {
+			segment = rest[:segmentSize]
+		}
+		decrypted, err = gcm.Open(decrypted, exportSegmentNonce(baseNonce, index), segment, exportSegmentData(final))
+		if err != nil {
+			return nil, err
+		}
+		if final {
+			return decrypted, nil
+		}
+		rest = rest[segmentSize:]
+	}
+}
+
+func Test_parseExportPublicKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err.Error())
+	}
+	pkixBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to encode key: %s", err.Error())
+	}
+
+	tests := []struct {
+		description string
+		key         string
+		expectErr   bool
+	}{{
+		description: "PKIX key should parse",
+		key:         string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkixBytes})),
+	}, {
+		description: "PKCS #1 key should parse",
+		key:         string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)})),
+	}, {
+		description: "non-PEM key should fail",
+		key:         "not a key",
+		expectErr:   true,
+	}, {
+		description: "private key should fail",
+		key:         string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+		expectErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := parseExportPublicKey(test.key)
+			if test.expectErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !test.expectErr && err != nil {
+				t.Errorf("unexpected error: %s", err.Error())
+			}
+		})
+	}
+}
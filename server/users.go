@@ -1,47 +1,280 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"strings"
+	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/pluginapi"
 )
 
-func getUsers(client *pluginapi.Client, targetInactiveOnly bool) ([]*model.User, error) {
-	options := model.UserGetOptions{
-		PerPage: 100,
+// selectionPageSize is the number of users read at a time while selecting
+// target users. Only the IDs of matching users are kept between pages.
+const selectionPageSize = 1000
+
+// userLoadBatchSize is the number of user records loaded per request.
+const userLoadBatchSize = 200
+
+// userQuery holds the criteria pushed down into the users query, so that
+// users who can't match are never loaded. Empty criteria match every user.
+type userQuery struct {
+	InactiveOnly bool
+	Role         string
+	AuthService  string
+
+	// MatchEmails limits the users to the email suffixes and addresses.
+	// With neither given, no users match.
+	MatchEmails   bool
+	EmailSuffixes []string
+	Emails        []string
+}
+
+// userPageFilter selects users from a page of loaded users, for criteria
+// that can't be checked in the users query.
+type userPageFilter func(users []*model.User) ([]*model.User, error)
+
+// emailQuery returns the query for the email filters.
+func emailQuery(inactiveOnly bool, suffixes, emails []string) userQuery {
+	return userQuery{
+		InactiveOnly:  inactiveOnly,
+		MatchEmails:   true,
+		EmailSuffixes: suffixes,
+		Emails:        emails,
+	}
+}
+
+// conditions returns the query's criteria as SQL. They may match more users
+// than matches does, for example under a case-insensitive collation, but
+// never fewer. System administrators aren't excluded here, so selectUserIDs
+// can warn about the ones that are targeted.
+func (q userQuery) conditions() sq.And {
+	// Bots are only deleted through the bots target users.
+	conditions := sq.And{
+		sq.Expr("NOT EXISTS (SELECT 1 FROM Bots WHERE Bots.UserId = Users.Id)"),
 	}
-	if targetInactiveOnly {
-		options.Inactive = true
+	if q.InactiveOnly {
+		conditions = append(conditions, sq.NotEq{"Users.DeleteAt": 0})
+	}
+	if q.Role != "" {
+		conditions = append(conditions, sq.Expr("CONCAT(' ', Users.Roles, ' ') LIKE ?", "% "+escapeLike(q.Role)+" %"))
+	}
+	if q.AuthService != "" {
+		conditions = append(conditions, sq.Eq{"Users.AuthService": q.AuthService})
+	}
+	if q.MatchEmails {
+		emails := sq.Or{sq.Expr("1 = 0")}
+		for _, suffix := range q.EmailSuffixes {
+			emails = append(emails, sq.Like{"Users.Email": "%" + escapeLike(suffix)})
+		}
+		if len(q.Emails) > 0 {
+			emails = append(emails, sq.Eq{"Users.Email": q.Emails})
+		}
+		conditions = append(conditions, emails)
+	}
+	return conditions
+}
+
+// matches applies the query to a loaded user. It repeats the database's
+// checks so matching doesn't depend on its collation. System administrators
+// can't be permanently deleted, so they never match.
+func (q userQuery) matches(user *model.User) bool {
+	return !user.IsInRole(model.SystemAdminRoleId) && q.matchesCriteria(user)
+}
+
+// matchesCriteria applies the query's criteria to a loaded user, without
+// excluding system administrators.
+func (q userQuery) matchesCriteria(user *model.User) bool {
+	if user.IsBot {
+		return false
+	}
+	if q.InactiveOnly && user.DeleteAt == 0 {
+		return false
+	}
+	if q.Role != "" && !user.IsInRole(q.Role) {
+		return false
+	}
+	if q.AuthService != "" && user.AuthService != q.AuthService {
+		return false
+	}
+	return !q.MatchEmails || emailMatches(user, q.EmailSuffixes, q.Emails)
+}
+
+// escapeLike escapes the LIKE wildcards in a value.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// selectTargetUsers returns the IDs of the users targeted by a command's
+// target users argument. The filter expression only applies to the filter
+// target users.
+func (p *Plugin) selectTargetUsers(target string, filterExpression string) ([]string, error) {
+	config := p.getConfiguration()
+
+	switch target {
+	case UsersFilter:
+		return p.selectFilteredUsers(filterExpression)
+	case UsersBots:
+		return p.getStaleBots()
+	case UsersGuests:
+		return p.getExpiredGuests()
+	case UsersLDAP:
+		now := time.Now()
+		return p.selectUserIDs(userQuery{InactiveOnly: true, AuthService: model.UserAuthServiceLdap}, func(users []*model.User) ([]*model.User, error) {
+			return selectLDAPRemovedUsers(users, now, config.LDAPDeletionDelayDays), nil
+		})
+	}
+
+	return p.selectUserIDs(emailQuery(target == UsersInactive, config.TargetEmailAddressSuffixes(), config.TargetEmailAddresses()), nil)
+}
+
+// selectUserIDs returns the IDs of the users matching the query. The users
+// the query selects are loaded a page at a time and checked with matches, and
+// if keep is given only the users keep returns are selected.
+func (p *Plugin) selectUserIDs(query userQuery, keep userPageFilter) ([]string, error) {
+	db, err := getDatabase(p.pluginClient)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing database: %s", err.Error())
+	}
+
+	var selected []string
+	err = forEachUserIDPage(db, query, func(userIDs []string) error {
+		users, err := loadUsers(p.socketClient, userIDs)
+		if err != nil {
+			return err
+		}
+		var matching []*model.User
+		for _, user := range users {
+			if query.matches(user) {
+				matching = append(matching, user)
+			} else if query.matchesCriteria(user) {
+				p.pluginClient.Log.Warn("targeted a sysadmin which is not supported: ignoring this user", "user_id", user.Id)
+			}
+		}
+		if keep != nil {
+			if matching, err = keep(matching); err != nil {
+				return err
+			}
+		}
+		selected = append(selected, getUserIDs(matching)...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	var users []*model.User
+	return selected, nil
+}
+
+// forEachUserIDPage calls fn with each page of the IDs of the users matching
+// the query, in ID order.
+func forEachUserIDPage(db *database, query userQuery, fn func(userIDs []string) error) error {
+	conditions := query.conditions()
+	lastID := ""
 	for {
-		page, err := client.User.List(&options)
+		queryString, args, err := sq.Select("Users.Id").
+			From("Users").
+			Where(conditions).
+			Where(sq.Gt{"Users.Id": lastID}).
+			OrderBy("Users.Id").
+			Limit(selectionPageSize).
+			PlaceholderFormat(db.placeholder()).
+			ToSql()
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("error when trying to build the users query: %s", err.Error())
+		}
+
+		userIDs, err := queryIDs(db, queryString, args...)
+		if err != nil {
+			return fmt.Errorf("error when trying to select users: %s", err.Error())
+		}
+		if len(userIDs) == 0 {
+			return nil
 		}
-		if len(page) == 0 {
-			break
+		if err = fn(userIDs); err != nil {
+			return err
+		}
+		if len(userIDs) < selectionPageSize {
+			return nil
+		}
+		lastID = userIDs[len(userIDs)-1]
+	}
+}
+
+// loadUsers returns the users with the given IDs, in the same order. Users
+// that no longer exist are left out.
+func loadUsers(socketClient *model.Client4, userIDs []string) ([]*model.User, error) {
+	byID := make(map[string]*model.User, len(userIDs))
+	for start := 0; start < len(userIDs); start += userLoadBatchSize {
+		end := start + userLoadBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		users, resp, err := socketClient.GetUsersByIds(context.Background(), userIDs[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("error when trying to load users: %s", err.Error())
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%d status code during attempt to load users", resp.StatusCode)
+		}
+		for _, user := range users {
+			byID[user.Id] = user
+		}
+	}
+
+	users := make([]*model.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if user, ok := byID[userID]; ok {
+			users = append(users, user)
 		}
-		users = append(users, page...)
-		options.Page++
 	}
 	return users, nil
 }
 
-func filterForUsersByEmails(client *pluginapi.Client, users []*model.User, targetEmailSuffixes, targetEmailAddresses []string) []*model.User {
-	var usersToDelete []*model.User
-	for _, user := range users {
-		// We can't permanently delete system administrators
-		if user.IsInRole(model.SystemAdminRoleId) {
-			client.Log.Warn("targeted a sysadmin which is not supported: ignoring this user", "user_id", user.Id)
-			continue
+// forEachUserBatch loads the given users a batch at a time, and calls fn
+// with each batch and the position of its first user.
+func forEachUserBatch(socketClient *model.Client4, userIDs []string, batchSize int, fn func(start int, users []*model.User) error) error {
+	for start := 0; start < len(userIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
 		}
-		if emailMatches(user, targetEmailSuffixes, targetEmailAddresses) {
-			usersToDelete = append(usersToDelete, user)
+		users, err := loadUsers(socketClient, userIDs[start:end])
+		if err != nil {
+			return err
+		}
+		if err = fn(start, users); err != nil {
+			return err
 		}
 	}
-	return usersToDelete
+	return nil
+}
+
+// uploadUserList uploads the emails of the given users, for the status post
+// of the job deleting them.
+func uploadUserList(client *pluginapi.Client, socketClient *model.Client4, channelID string, userIDs []string, fileName string) (string, error) {
+	var userList strings.Builder
+	err := forEachUserBatch(socketClient, userIDs, selectionPageSize, func(_ int, users []*model.User) error {
+		for _, user := range users {
+			if userList.Len() > 0 {
+				userList.WriteString(", ")
+			}
+			userList.WriteString(user.Email)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	fileInfo, err := client.File.Upload(strings.NewReader(userList.String()), fileName, channelID)
+	if err != nil {
+		return "", err
+	}
+	return fileInfo.Id, nil
 }
 
 func emailMatches(user *model.User, targetEmailSuffixes, targetEmailAddresses []string) bool {
@@ -57,3 +290,11 @@ func emailMatches(user *model.User, targetEmailSuffixes, targetEmailAddresses []
 	}
 	return false
 }
+
+func getUserIDs(users []*model.User) []string {
+	userIDs := make([]string, 0, len(users))
+	for _, user := range users {
+		userIDs = append(userIDs, user.Id)
+	}
+	return userIDs
+}
@@ -65,3 +65,68 @@ func Test_emailMatches(t *testing.T) {
 		})
 	}
 }
+
+func Test_escapeLike(t *testing.T) {
+	expected := `first\_last\%\\@example.com`
+	if got := escapeLike(`first_last%\@example.com`); got != expected {
+		t.Errorf("expected: '%s', got: '%s'", expected, got)
+	}
+}
+
+func Test_userQuery_matches(t *testing.T) {
+	tests := []struct {
+		description string
+		query       userQuery
+		user        model.User
+		expected    bool
+	}{{
+		description: "empty query should match users",
+		user:        model.User{Roles: model.SystemUserRoleId},
+		expected:    true,
+	}, {
+		description: "empty query should not match system admins",
+		user:        model.User{Roles: model.SystemUserRoleId + " " + model.SystemAdminRoleId},
+	}, {
+		description: "empty query should not match bots",
+		user:        model.User{IsBot: true},
+	}, {
+		description: "inactive query should not match active users",
+		query:       userQuery{InactiveOnly: true},
+		user:        model.User{},
+	}, {
+		description: "inactive query should match deactivated users",
+		query:       userQuery{InactiveOnly: true},
+		user:        model.User{DeleteAt: 1},
+		expected:    true,
+	}, {
+		description: "role query should match users in the role",
+		query:       userQuery{Role: model.SystemGuestRoleId},
+		user:        model.User{Roles: model.SystemGuestRoleId},
+		expected:    true,
+	}, {
+		description: "auth service query should not match other auth services",
+		query:       userQuery{AuthService: model.UserAuthServiceLdap},
+		user:        model.User{AuthService: model.UserAuthServiceSaml},
+	}, {
+		description: "email query should match email suffixes",
+		query:       emailQuery(false, []string{"@test.com"}, nil),
+		user:        model.User{Email: "user@test.com"},
+		expected:    true,
+	}, {
+		description: "email query should match email suffixes case-sensitively",
+		query:       emailQuery(false, []string{"@test.com"}, nil),
+		user:        model.User{Email: "user@TEST.com"},
+	}, {
+		description: "email query without emails should not match",
+		query:       emailQuery(false, nil, nil),
+		user:        model.User{Email: "user@test.com"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.query.matches(&test.user); got != test.expected {
+				t.Errorf("expected: '%t', got: '%t'", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// verifyColumns are the core Mattermost table columns that must not
+// reference any deleted user once a job has finished. Each cleanup stage
+// verifies its own tables.
+var verifyColumns = []tableColumn{
+	{"users", "id"},
+	{"posts", "userid"},
+	{"channelmembers", "userid"},
+	{"teammembers", "userid"},
+	{"fileinfo", "creatorid"},
+}
+
+// verifyDeletion re-queries the database for any data still referencing the
+// deleted users, in the core tables and those of the given cleanup stages.
+// With includeSchemaScan set, every column discovered by findUserIDColumns is
+// checked as well.
+func verifyDeletion(env *cleanupEnv, stages []cleanupStage, includeSchemaScan bool) ([]userReference, error) {
+	references, err := verifyTableColumns(env, verifyColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range stages {
+		stageReferences, err := stage.Verify(env)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying %s: %s", stage.Name(), err.Error())
+		}
+		references = append(references, stageReferences...)
+	}
+
+	if includeSchemaScan {
+		scannedColumns, err := findUserIDColumns(env.db)
+		if err != nil {
+			return nil, err
+		}
+		scannedReferences, err := findUserReferences(env.db, scannedColumns, env.userIDs)
+		if err != nil {
+			return nil, err
+		}
+		references = append(references, scannedReferences...)
+	}
+
+	// The schema scan finds many of the columns checked above again, so only
+	// keep the first reference to each table column and user.
+	var deduplicated []userReference
+	seen := map[userReference]bool{}
+	for _, reference := range references {
+		key := userReference{
+			Table:  strings.ToLower(reference.Table),
+			Column: strings.ToLower(reference.Column),
+			UserID: reference.UserID,
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduplicated = append(deduplicated, reference)
+	}
+
+	return deduplicated, nil
+}